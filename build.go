@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+import (
+	"github.com/hidez8891/gomk/lib/parser"
+	"github.com/hidez8891/gomk/lib/runner"
+)
+
+// buildError is a failure to make a target.
+// command is empty when the failure is not caused by a command.
+type buildError struct {
+	target  string
+	command string
+	err     error
+}
+
+// Error returns the description of the failure with the target.
+func (e *buildError) Error() string {
+	if e.command == "" {
+		return fmt.Sprintf("%s: %s", e.target, e.err)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.target, e.err, e.command)
+}
+
+// builder executes the rule of each scheduled target.
+type builder struct {
+	rules                *parser.MakeRule
+	outStream, errStream io.Writer
+	outdate              *outdateChecker
+	dryRun               bool
+	env                  []string // environment of the CLI
+	variables            []string
+}
+
+func newBuilder(rules *parser.MakeRule, out, err io.Writer) *builder {
+	return &builder{
+		rules:     rules,
+		outStream: out,
+		errStream: err,
+		outdate:   newOutdateChecker(modTime, rules.Phony),
+	}
+}
+
+// build runs the commands of node if it is outdated,
+// and reports whether they were run.
+// In dry-run mode the commands are only printed, except forced ones.
+func (b *builder) build(node *scheduleNode) (bool, error) {
+	target := node.target
+
+	rule := node.match
+	if rule == nil {
+		if !b.rules.Phony[target] && !fileExists(target) {
+			return false, errors.New("Not found make rule " + target)
+		}
+		return false, nil
+	}
+
+	if !b.outdate.isOutdated(target, rule.Depends) {
+		return false, nil
+	}
+
+	auto := &parser.Automatic{
+		Target:  target,
+		Depends: rule.Depends,
+		Newer:   b.outdate.newer(target, rule.Depends),
+		Stem:    rule.Stem,
+	}
+
+	env, err := b.environ(target, auto)
+	if err != nil {
+		return false, &buildError{target, "", err}
+	}
+	runner := runner.NewWithShell(b.outStream, b.errStream, b.rules.Shell(target))
+	runner.SetEnv(env)
+
+	// all commands are expanded before running
+	commands := []parser.Command{}
+	for _, cmd := range rule.Commands {
+		cmds, err := b.rules.ExpandCommands(target, auto, cmd)
+		if err != nil {
+			return false, &buildError{target, "", err}
+		}
+		commands = append(commands, cmds...)
+	}
+
+	for _, cmd := range commands {
+		if cmd.NeedEcho || b.dryRun {
+			fmt.Fprintf(b.outStream, "%s\n", cmd.Exestr)
+		}
+		if b.dryRun && !cmd.Force {
+			continue
+		}
+
+		if err := runner.Run(cmd.Exestr); err != nil {
+			if cmd.IgnoreError {
+				fmt.Fprintf(b.errStream, "%s: %s (ignored)\n", target, err)
+				continue
+			}
+			return true, &buildError{target, cmd.Exestr, err}
+		}
+	}
+
+	b.outdate.setRebuilt(rule.Targets...)
+	return true, nil
+}
+
+// environ returns the environment of the commands of target.
+// The command line variables are passed to recursive invocations
+// through MAKEFLAGS.
+func (b *builder) environ(target string, auto *parser.Automatic) ([]string, error) {
+	env, err := b.rules.Environ(target, auto, b.env)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.variables) > 0 {
+		env = append(env, "MAKEFLAGS="+encodeMakeflags(b.variables))
+	}
+	return env, nil
+}
@@ -5,11 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 import (
 	"github.com/hidez8891/gomk/lib/parser"
-	"github.com/hidez8891/gomk/lib/runner"
 )
 
 // Exit codes are int values that represent an exit code for a particular error.
@@ -21,6 +23,13 @@ const (
 // CLI is the command line object
 type CLI struct {
 	outStream, errStream io.Writer
+	environ              []string // "NAME=value" of the environment
+	jobs                 int
+	dryRun               bool
+	keepGoing            bool
+	includeDirs          stringList
+	variables            []string
+	environmentOverrides bool
 }
 
 // Run invokes the CLI with the given arguments.
@@ -30,18 +39,30 @@ func (cli *CLI) Run(args []string) int {
 		version bool
 	)
 
+	// streams are shared by the parallel jobs and $(shell) commands
+	cli.outStream, cli.errStream = newSyncWriters(cli.outStream, cli.errStream)
+
 	// Define option flag parse
 	flags := flag.NewFlagSet(Name, flag.ContinueOnError)
 	flags.SetOutput(cli.errStream)
 
 	flags.StringVar(&file, "f", "", "input makefile")
+	flags.IntVar(&cli.jobs, "j", 1, "Number of jobs to run simultaneously (unlimited without number).")
+	flags.BoolVar(&cli.dryRun, "n", false, "Print the commands that would be executed, but do not execute them.")
+	flags.BoolVar(&cli.keepGoing, "k", false, "Keep going when some targets can't be made.")
+	flags.BoolVar(&cli.environmentOverrides, "e", false, "Environment variables override makefiles.")
+	flags.Var(&cli.includeDirs, "I", "Search `dir` for included makefiles.")
 	flags.BoolVar(&version, "version", false, "Print version information and quit.")
 
 	// Parse commandline flag
-	if err := flags.Parse(args[1:]); err != nil {
+	if err := flags.Parse(jobsArgs(args[1:])); err != nil {
 		fmt.Fprintf(cli.errStream, "%s\n", err)
 		return ExitCodeError
 	}
+	if cli.jobs < 0 {
+		fmt.Fprintf(cli.errStream, "invalid value %d for flag -j\n", cli.jobs)
+		return ExitCodeError
+	}
 
 	// Show version
 	if version {
@@ -56,8 +77,10 @@ func (cli *CLI) Run(args []string) int {
 		return ExitCodeError
 	}
 
-	// Get targets
-	targets := flags.Args()
+	// Get variables and targets
+	// variables of the parent make are overridden by the command line
+	assigns, targets := splitAssignArgs(flags.Args())
+	cli.variables = append(decodeMakeflags(cli.getenv("MAKEFLAGS")), assigns...)
 
 	// Parse makefile
 	rules, err := cli.parseMakefile(file)
@@ -65,23 +88,75 @@ func (cli *CLI) Run(args []string) int {
 		fmt.Fprintf(cli.errStream, "%s\n", err)
 		return ExitCodeError
 	}
+	for _, w := range rules.Warnings {
+		fmt.Fprintf(cli.errStream, "%s: warning: %s\n", w.Position, w.Message)
+	}
 
 	// if not defined target, set default target
 	if len(targets) == 0 {
-		targets = searchMapKeys(rules.Targets, 0)
-	}
-
-	// Run targets
-	for _, target := range targets {
-		if err := cli.runRules(rules, target); err != nil {
+		goal, err := rules.DefaultGoal()
+		if err != nil {
 			fmt.Fprintf(cli.errStream, "%s\n", err)
 			return ExitCodeError
 		}
+		targets = []string{goal}
+	}
+
+	// Run targets
+	if err := cli.runRules(rules, targets); err != nil {
+		fmt.Fprintf(cli.errStream, "%s\n", err)
+		return ExitCodeError
 	}
 
 	return ExitCodeOK
 }
 
+// jobsArgs rewrites -j options to the form of the flag package.
+// "-j N" and "-jN" become "-j=N", and "-j" without number becomes "-j=0".
+func jobsArgs(args []string) []string {
+	jobs_class := regexp.MustCompile(`^--?j(\d+)$`)
+
+	res := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			return append(res, args[i:]...)
+		}
+
+		if m := jobs_class.FindStringSubmatch(arg); len(m) != 0 {
+			res = append(res, "-j="+m[1])
+			continue
+		}
+
+		if arg == "-j" || arg == "--j" {
+			if i+1 < len(args) {
+				if _, err := strconv.Atoi(args[i+1]); err == nil {
+					res = append(res, "-j="+args[i+1])
+					i++
+					continue
+				}
+			}
+			res = append(res, "-j=0")
+			continue
+		}
+
+		res = append(res, arg)
+	}
+
+	return res
+}
+
+// getenv returns the value of the environment variable name.
+func (cli *CLI) getenv(name string) string {
+	for _, env := range cli.environ {
+		if strings.HasPrefix(env, name+"=") {
+			return env[len(name)+1:]
+		}
+	}
+	return ""
+}
+
 func (cli *CLI) parseMakefile(path string) (*parser.MakeRule, error) {
 	reader, err := openMakefile(path)
 	if err != nil {
@@ -89,7 +164,9 @@ func (cli *CLI) parseMakefile(path string) (*parser.MakeRule, error) {
 	}
 	defer closeMakefile(reader)
 
-	rules, err := parser.Parse(reader)
+	rules, err := parser.Parse(reader, parser.FileName(path), parser.IncludeDirs(cli.includeDirs...),
+		parser.Environment(cli.environ, cli.environmentOverrides),
+		parser.CommandLineVariables(cli.variables...), parser.Stderr(cli.errStream))
 	if err != nil {
 		return nil, err
 	}
@@ -101,104 +178,48 @@ func (cli *CLI) parseMakefile(path string) (*parser.MakeRule, error) {
 	return rules, nil
 }
 
-func (cli *CLI) runRules(rules *parser.MakeRule, root string) error {
-	pre_time := int64(0)
-	pre_target := ""
-	at_least_one_running := false
-
-	schedule := cli.makeExecuteSchedule(rules, root)
-	if len(schedule) == 0 {
+// runRules makes the goals with one schedule, so that a target depended
+// by several goals is made once, and the goals are made in parallel.
+func (cli *CLI) runRules(rules *parser.MakeRule, goals []string) error {
+	schedule := cli.makeExecuteSchedule(rules, goals...)
+	if len(schedule.nodes) == 0 {
 		return nil
 	}
 
-	for _, target := range schedule {
-		do_execute := true
+	builder := newBuilder(rules, cli.outStream, cli.errStream)
+	builder.dryRun = cli.dryRun
+	builder.env = cli.environ
+	builder.variables = cli.variables
 
-		target_t, err := modTime(target)
-		if err != nil {
-			target_t = 0
-		}
-
-		id, ok := rules.Targets[target]
-		if target_t == 0 && !ok {
-			return errors.New("Not found make rule " + target)
-		}
-		if !ok {
-			do_execute = false
-		}
-
-		rule := rules.Rules[id]
-		if inArray(rule.Depends, pre_target) && pre_time < target_t {
-			do_execute = false
-		}
-
-		pre_target = target
-		pre_time = target_t
-
-		if !do_execute {
-			continue
-		}
-
-		runner := runner.New(cli.outStream, cli.errStream)
-		for _, cmd := range rule.Commands {
-			if cmd.NeedEcho {
-				fmt.Fprintf(cli.outStream, "%s\n", cmd.Exestr)
-			}
-
-			if err := runner.Run(cmd.Exestr); err != nil {
-				return err
-			}
-		}
-
-		at_least_one_running = true
+	_, errs := schedule.run(cli.jobs, cli.keepGoing, builder.build)
+	if len(errs) > 0 && !cli.keepGoing {
+		return errs[0]
 	}
 
-	if !at_least_one_running {
-		fmt.Fprintf(cli.outStream, "'%s' is up to date\n", root)
+	if len(errs) > 0 {
+		fmt.Fprintf(cli.errStream, "Failed targets:\n")
+		for _, err := range errs {
+			fmt.Fprintf(cli.errStream, "  %s\n", err)
+		}
 	}
 
-	return nil
-}
-
-func (cli *CLI) makeExecuteSchedule(rules *parser.MakeRule, target string) []string {
-	return cli.makeExecuteScheduleImpl(rules, target, []string{}, []string{})
-}
-
-func (cli *CLI) makeExecuteScheduleImpl(rules *parser.MakeRule, target string, parent, schedule []string) []string {
-	inSameRule := func(keys []string, t string) bool {
-		id, ok := rules.Targets[t]
-		if !ok {
-			return false
+	messages := []string{}
+	for _, goal := range schedule.goals {
+		ran, failed := false, false
+		for _, node := range schedule.reached(goal) {
+			ran = ran || node.ran
+			failed = failed || node.failed
 		}
 
-		for _, key := range keys {
-			key_id, _ := rules.Targets[key]
-			if key_id == id {
-				return true
-			}
+		if failed {
+			messages = append(messages, "Target '"+goal.target+"' not remade because of errors")
+		} else if !ran {
+			fmt.Fprintf(cli.outStream, "'%s' is up to date\n", goal.target)
 		}
-		return false
-	}
-
-	if inSameRule(schedule, target) {
-		return schedule
-	}
-
-	id, ok := rules.Targets[target]
-	if !ok {
-		return append(schedule, target)
 	}
-	rule := rules.Rules[id]
-
-	parent = append(parent, target)
-	for _, depend := range rule.Depends {
-		if inSameRule(parent, depend) {
-			fmt.Fprintf(cli.errStream, "Circular %s <- %s dependency dropped\n", target, depend)
-			continue
-		}
-
-		schedule = cli.makeExecuteScheduleImpl(rules, depend, parent, schedule)
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "\n"))
 	}
 
-	return append(schedule, target)
+	return nil
 }
@@ -4,10 +4,81 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
 	"testing"
 )
 
+// any_output matches any output in run_cli.
+const any_output = "*"
+
+// cli_test is a command line and its expected results.
+// An expected output ending with "..." is compared as a prefix.
+type cli_test struct {
+	comment string
+	exe_str string
+	status  int
+	out     string
+	err     string
+}
+
+// run_cli runs the CLI with exe_str, checks the exit status and the outputs,
+// and returns the standard output.
+func run_cli(t *testing.T, tt cli_test) string {
+	t.Helper()
+	return run_cli_env(t, nil, tt)
+}
+
+// run_cli_env is run_cli with the environment variables env added.
+// MAKEFLAGS of the environment running the tests is not given to the CLI.
+func run_cli_env(t *testing.T, env []string, tt cli_test) string {
+	t.Helper()
+
+	environ := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "MAKEFLAGS=") {
+			environ = append(environ, e)
+		}
+	}
+
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	cli := &CLI{outStream: outStream, errStream: errStream, environ: append(environ, env...)}
+
+	status := cli.Run(strings.Split(tt.exe_str, " "))
+	if status != tt.status {
+		t.Errorf("%s: expected %d to eq %d", tt.comment, status, tt.status)
+	}
+	if !match_output(outStream.String(), tt.out) {
+		t.Errorf("%s: expected %q to eq %q", tt.comment, outStream.String(), tt.out)
+	}
+	if !match_output(errStream.String(), tt.err) {
+		t.Errorf("%s: expected %q to eq %q", tt.comment, errStream.String(), tt.err)
+	}
+
+	return outStream.String()
+}
+
+func match_output(result, expected string) bool {
+	if expected == any_output {
+		return true
+	}
+	if prefix := strings.TrimSuffix(expected, "..."); prefix != expected {
+		return strings.HasPrefix(result, prefix)
+	}
+	return result == expected
+}
+
+func run_cli_tests(t *testing.T, tests []cli_test) {
+	t.Helper()
+
+	for _, tt := range tests {
+		run_cli(t, tt)
+	}
+}
+
 func TestRun_versionFlag(t *testing.T) {
 	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
 	cli := &CLI{outStream: outStream, errStream: errStream}
@@ -95,6 +166,24 @@ func TestRun_targetRules(t *testing.T) {
 		t.Error(err)
 	}
 
+	// default goal is the first target
+	for i := 0; i < 5; i++ {
+		exe_str = "./gomk -f test/test014.mk"
+		expected_out = "echo1\n"
+		expected_err = ""
+		if err := tester(exe_str, expected_out, expected_err); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// declared default goal
+	exe_str = "./gomk -f test/test015.mk"
+	expected_out = "echo3\n"
+	expected_err = ""
+	if err := tester(exe_str, expected_out, expected_err); err != nil {
+		t.Error(err)
+	}
+
 	// set target
 	exe_str = "./gomk -f test/test002.mk echo2"
 	expected_out = "echo echo2\necho2\n"
@@ -121,35 +210,60 @@ func TestRun_targetRules(t *testing.T) {
 
 	// loop rules
 	exe_str = "./gomk -f test/test003.mk"
-	expected_out = "\"rule3\"\n\"rule2\"\n\"rule1\"\n"
+	expected_out = "rule3\nrule2\nrule1\n"
 	expected_err = "Circular rule3 <- rule1 dependency dropped\n"
 	if err := tester(exe_str, expected_out, expected_err); err != nil {
 		t.Error(err)
 	}
 
 	// file update
-	exe_str = "./gomk -f test/test004.mk init"
+	test004 := "test/test004.mk"
+	if runtime.GOOS == "windows" {
+		test004 = "test/test004_windows.mk"
+	}
+	exe_str = "./gomk -f " + test004 + " init"
 	expected_out = "init\n"
 	expected_err = ""
 	if err := tester(exe_str, expected_out, expected_err); err != nil {
 		t.Error(err)
 	}
-	exe_str = "./gomk -f test/test004.mk file1.tmp"
+	exe_str = "./gomk -f " + test004 + " file1.tmp"
 	expected_out = "file2: run\nfile1: run\n"
 	if err := tester(exe_str, expected_out, expected_err); err != nil {
 		t.Error(err)
 	}
-	exe_str = "./gomk -f test/test004.mk file1.tmp"
+	exe_str = "./gomk -f " + test004 + " file1.tmp"
 	expected_out = "'file1.tmp' is up to date\n"
 	if err := tester(exe_str, expected_out, expected_err); err != nil {
 		t.Error(err)
 	}
-	exe_str = "./gomk -f test/test004.mk clean"
+	exe_str = "./gomk -f " + test004 + " clean"
 	expected_out = ""
 	if err := tester(exe_str, expected_out, expected_err); err != nil {
 		t.Error(err)
 	}
 
+	// multiple dependencies update
+	exe_str = "./gomk -f test/test008.mk"
+	expected_out = "dep1: run\ndep2: run\ntarget: run\n"
+	if err := tester(exe_str, expected_out, expected_err); err != nil {
+		t.Error(err)
+	}
+	exe_str = "./gomk -f test/test008.mk"
+	expected_out = "'target.tmp' is up to date\n"
+	if err := tester(exe_str, expected_out, expected_err); err != nil {
+		t.Error(err)
+	}
+	os.Remove("dep1.tmp")
+	exe_str = "./gomk -f test/test008.mk"
+	expected_out = "dep1: run\ntarget: run\n"
+	if err := tester(exe_str, expected_out, expected_err); err != nil {
+		t.Error(err)
+	}
+	os.Remove("dep1.tmp")
+	os.Remove("dep2.tmp")
+	os.Remove("target.tmp")
+
 	// deduplicate rules
 	exe_str = "./gomk -f test/test005.mk"
 	expected_out = "echo4\necho3\necho1\necho2\n"
@@ -158,11 +272,242 @@ func TestRun_targetRules(t *testing.T) {
 		t.Error(err)
 	}
 
-	// deduplicate rules
+	// automatic variables
+	exe_str = "./gomk -f test/test009.mk"
+	expected_out = "dir echo1\n. echo2\n" +
+		"echo3 from dir/echo1 and dir/echo1 echo2\necho4 from dir/echo1 and dir/echo1 echo2\n"
+	expected_err = ""
+	if err := tester(exe_str, expected_out, expected_err); err != nil {
+		t.Error(err)
+	}
+	exe_str = "./gomk -f test/test009.mk echo4"
+	expected_out = "dir echo1\n. echo2\necho4 from dir/echo1 and dir/echo1 echo2\n"
+	expected_err = ""
+	if err := tester(exe_str, expected_out, expected_err); err != nil {
+		t.Error(err)
+	}
+
+	// pattern rules
+	exe_str = "./gomk -f test/test010.mk"
+	expected_out = "test/test010.mid from test/test010.src stem test/test010\nspecific test/test010.out from test/test010.mid stem 010\n"
+	expected_err = ""
+	if err := tester(exe_str, expected_out, expected_err); err != nil {
+		t.Error(err)
+	}
+
+	// each target of a rule runs the recipe
 	exe_str = "./gomk -f test/test006.mk"
-	expected_out = "echo3 and echo4\necho1\necho2\n"
+	expected_out = "echo3 and echo4\necho1\necho3 and echo4\necho2\n"
 	expected_err = ""
 	if err := tester(exe_str, expected_out, expected_err); err != nil {
 		t.Error(err)
 	}
 }
+func TestRun_shellVariables(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	run_cli_tests(t, []cli_test{
+		{"global and target-specific .SHELLFLAGS", "./gomk -f test/test007.mk", ExitCodeOK, "strict\nlenient\n", any_output},
+		{"global .SHELLFLAGS stops on error", "./gomk -f test/test007.mk errexit", ExitCodeError, "", any_output},
+		{"target-specific SHELL", "./gomk -f test/test007.mk bash", ExitCodeOK, "bash\n", any_output},
+	})
+}
+
+func TestRun_jobsFlag(t *testing.T) {
+	run_cli_tests(t, []cli_test{
+		{"single job keeps execution order", "./gomk -j 1 -f test/test005.mk", ExitCodeOK, "echo4\necho3\necho1\necho2\n", any_output},
+		{"invalid jobs", "./gomk -j=-1 -f test/test005.mk", ExitCodeError, any_output, any_output},
+	})
+
+	// unlimited jobs runs each target once after its dependencies
+	out := run_cli(t, cli_test{"unlimited jobs", "./gomk -j -f test/test005.mk", ExitCodeOK, any_output, any_output})
+
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	sorted := append([]string{}, lines...)
+	sort.Strings(sorted)
+	expected := []string{"echo1", "echo2", "echo3", "echo4"}
+	if !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("expected %q to eq %q", sorted, expected)
+	}
+
+	index := map[string]int{}
+	for i, line := range lines {
+		index[line] = i
+	}
+	for _, order := range [][2]string{{"echo4", "echo3"}, {"echo3", "echo1"}, {"echo4", "echo2"}} {
+		if index[order[0]] > index[order[1]] {
+			t.Errorf("expected %s to run before %s in %q", order[0], order[1], lines)
+		}
+	}
+}
+
+func TestRun_dryRunFlag(t *testing.T) {
+	expected_out := "echo dep1: run\necho \"\" > dep1.tmp\n" +
+		"echo dep2: run\necho \"\" > dep2.tmp\n" +
+		"echo target: run\necho \"\" > target.tmp\n"
+	run_cli_tests(t, []cli_test{
+		{"print commands including no-echo ones", "./gomk -n -f test/test008.mk", ExitCodeOK, expected_out, any_output},
+		{"planning error", "./gomk -n -f test/test010.mk test/missing.out", ExitCodeError, "", any_output},
+	})
+
+	// nothing is executed
+	for _, file := range []string{"dep1.tmp", "dep2.tmp", "target.tmp"} {
+		if fileExists(file) {
+			t.Errorf("expected %q not to exist", file)
+			os.Remove(file)
+		}
+	}
+}
+
+func TestRun_keepGoingFlag(t *testing.T) {
+	run_cli_tests(t, []cli_test{
+		{"stop on first failure", "./gomk -f test/test011.mk", ExitCodeError, "", "Not found make rule missing\n"},
+		{"failed command with the target", "./gomk -f test/test011.mk broken2", ExitCodeError, "broken2\n", "broken2: exit status 3: exit 3\n"},
+		{"keep going and summarize failures", "./gomk -k -f test/test011.mk", ExitCodeError, "good\nbroken2\n",
+			"Failed targets:\n" +
+				"  Not found make rule missing\n" +
+				"  broken2: exit status 3: exit 3\n" +
+				"Target 'all' not remade because of errors\n"},
+	})
+}
+
+func TestRun_commandPrefix(t *testing.T) {
+	run_cli_tests(t, []cli_test{
+		{"ignore error", "./gomk -f test/test012.mk", ExitCodeOK,
+			"after ignored\nforced\necho normal\nnormal\n", "all: exit status 2 (ignored)\n"},
+		{"force execute in dry-run mode", "./gomk -n -f test/test012.mk", ExitCodeOK,
+			"exit 2\necho after ignored\necho forced\nforced\necho normal\n", ""},
+	})
+}
+
+func TestRun_phonyTargets(t *testing.T) {
+	// files with the same names as phony targets
+	for _, file := range []string{"clean", "build", "output.tmp"} {
+		if err := os.WriteFile(file, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file)
+	}
+
+	run_cli_tests(t, []cli_test{
+		{"files with the same names", "./gomk -f test/test013.mk clean build", ExitCodeOK, "clean\nbuild\n", any_output},
+		{"phony dependency is always newer", "./gomk -f test/test013.mk output.tmp", ExitCodeOK, "build\noutput\n", any_output},
+	})
+}
+
+func TestRun_includeDirective(t *testing.T) {
+	run_cli_tests(t, []cli_test{
+		{"include with search directory", "./gomk -I test/include/dirs -f test/test016.mk all", ExitCodeOK,
+			"common\nparts\nsearched\ntool\n", ""},
+		{"missing include file", "./gomk -f test/test016.mk all", ExitCodeError,
+			"", "test/include/sub/part1.mk:1: Not found include file searched.mk..."},
+		{"include cycle", "./gomk -f test/test017.mk", ExitCodeError, "", "test/include/cycle.mk:1: Include cycle..."},
+	})
+}
+
+func TestRun_commandLineVariables(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	run_cli_tests(t, []cli_test{
+		{"makefile values", "./gomk -f test/test018.mk", ExitCodeOK, "gcc -O2\n\n\n", any_output},
+		{"command line values are exported and passed through MAKEFLAGS", "./gomk -f test/test018.mk TOOL=clang FLAGS:=-g all", ExitCodeOK,
+			"clang -O2\nclang\n-- TOOL=clang FLAGS:=-g\n", any_output},
+	})
+
+	// values from the parent make
+	run_cli_env(t, []string{`MAKEFLAGS=-- TOOL=cc\ -m64`}, cli_test{"values from the parent make", "./gomk -f test/test018.mk", ExitCodeOK,
+		"cc -m64 -O2\ncc -m64\n-- TOOL=cc\\ -m64\n", any_output})
+}
+
+func TestRun_splitAssignArgs(t *testing.T) {
+	assigns, targets := splitAssignArgs([]string{"A=1", "all", "B:=2", "C+=3", "=x", "clean"})
+
+	expected := []string{"A=1", "B:=2"}
+	if !reflect.DeepEqual(assigns, expected) {
+		t.Errorf("expected %q to eq %q", assigns, expected)
+	}
+	expected = []string{"all", "C+=3", "=x", "clean"}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %q to eq %q", targets, expected)
+	}
+
+	expected = []string{"A=a b", `B=c\d`}
+	flags := encodeMakeflags(expected)
+	if result := decodeMakeflags("k " + flags); !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %q to eq %q", result, expected)
+	}
+
+	// options of the parent make are not variables
+	result := decodeMakeflags("ik --jobserver-auth=3,4 -- A=1")
+	if expected = []string{"A=1"}; !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %q to eq %q", result, expected)
+	}
+	result = decodeMakeflags("k --jobserver-auth=3,4 A=1")
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %q to eq %q", result, expected)
+	}
+}
+
+func TestRun_environmentVariables(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	env := []string{"GOMK_ENV=env"}
+	run_cli_env(t, env, cli_test{"makefile overrides the environment", "./gomk -f test/test019.mk", ExitCodeOK,
+		"makefile\nmakefile exported\n", any_output})
+	run_cli_env(t, env, cli_test{"environment overrides the makefile", "./gomk -e -f test/test019.mk", ExitCodeOK,
+		"env\nenv exported\n", any_output})
+}
+
+func TestRun_cannedRecipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	run_cli(t, cli_test{"canned recipe", "./gomk -f test/test020.mk", ExitCodeOK,
+		"hello all\nbye all\n", "all: exit status 1 (ignored)\n"})
+}
+
+func TestRun_mergeRules(t *testing.T) {
+	run_cli(t, cli_test{"merge rules", "./gomk -f test/test021.mk", ExitCodeOK,
+		"build main.o from main.h\nrecompile util.o from util.h\n",
+		"test/test021.mk:12: warning: Overriding recipe for target util.o\n" +
+			"test/test021.mk:10: warning: Ignoring old recipe for target util.o\n"})
+}
+
+func TestRun_recipeExpansion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	// functions in recipes never run are not called
+	run_cli(t, cli_test{"recipes never run", "./gomk -f test/test022.mk", ExitCodeOK, "all\n", any_output})
+	if fileExists("shell.tmp") {
+		t.Errorf("expected %q not to exist", "shell.tmp")
+	}
+	os.Remove("shell.tmp")
+
+	// functions see the files made by the dependencies
+	run_cli(t, cli_test{"files made by the dependencies", "./gomk -f test/test022.mk objs", ExitCodeOK, "objs=a.gen.tmp\n", any_output})
+	os.Remove("a.gen.tmp")
+}
+
+func TestRun_substRefRules(t *testing.T) {
+	run_cli(t, cli_test{"substitution references in rules", "./gomk -f test/test023.mk", ExitCodeOK,
+		"main.h\nutil.h\nmain.o from common.h\nutil.o from common.h\nall from main.o util.o\n", ""})
+}
+
+func TestRun_multipleGoals(t *testing.T) {
+	run_cli_tests(t, []cli_test{
+		{"shared dependency made once", "./gomk -f test/test024.mk a b", ExitCodeOK, "c\na\nb\n", ""},
+		{"goal up to date", "./gomk -f test/test024.mk test/test024.mk a", ExitCodeOK,
+			"c\na\n'test/test024.mk' is up to date\n", ""},
+		{"missing goal", "./gomk -k -f test/test024.mk missing a", ExitCodeError, "c\na\n",
+			"Failed targets:\n  Not found make rule missing\nTarget 'missing' not remade because of errors\n"},
+	})
+}
@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"path"
+	"strings"
+)
+
+// Automatic holds the values of automatic variables for a target.
+type Automatic struct {
+	Target  string   // $@
+	Depends []string // $^ and $+, the first one is $<
+	Newer   []string // $?
+	Stem    string   // $*
+}
+
+func isAutomatic(name string) bool {
+	if len(name) == 2 && (name[1] == 'D' || name[1] == 'F') {
+		name = name[:1]
+	}
+	return len(name) == 1 && strings.Contains("@<^+?*", name)
+}
+
+// value returns the value of the automatic variable name.
+// A nil Automatic has no values.
+func (a *Automatic) value(name string) (string, bool) {
+	if a == nil || !isAutomatic(name) {
+		return "", false
+	}
+
+	var words []string
+	switch name[0] {
+	case '@':
+		words = []string{a.Target}
+	case '<':
+		if len(a.Depends) > 0 {
+			words = []string{a.Depends[0]}
+		}
+	case '^':
+		words = uniqueWords(a.Depends)
+	case '+':
+		words = a.Depends
+	case '?':
+		words = uniqueWords(a.Newer)
+	case '*':
+		words = []string{a.Stem}
+	}
+
+	if len(name) == 2 {
+		res := []string{}
+		for _, w := range words {
+			if name[1] == 'D' {
+				res = append(res, path.Dir(w))
+			} else {
+				res = append(res, path.Base(w))
+			}
+		}
+		words = res
+	}
+
+	return strings.Join(words, " "), true
+}
+
+func uniqueWords(words []string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			res = append(res, w)
+		}
+	}
+	return res
+}
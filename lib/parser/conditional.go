@@ -0,0 +1,162 @@
+package parser
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// conditional is the state of a conditional block.
+type conditional struct {
+	parent bool // the enclosing block is active
+	active bool // the current branch is taken
+	taken  bool // one of the branches is taken
+	inElse bool // the last branch is started by else without condition
+	pos    Position
+}
+
+var (
+	cond_class  = regexp.MustCompile(`^ *(ifeq|ifneq|ifdef|ifndef)(?:\s+(.*?))?\s*$`)
+	else_class  = regexp.MustCompile(`^ *else(?:\s+(.*?))?\s*$`)
+	endif_class = regexp.MustCompile(`^ *endif\s*$`)
+)
+
+// conditionActive reports whether lines are used in the current block.
+func (o *Parser) conditionActive() bool {
+	if len(o.conds) == 0 {
+		return true
+	}
+	top := o.conds[len(o.conds)-1]
+	return top.parent && top.active
+}
+
+// parseConditional evaluates line if it is a conditional directive,
+// and reports whether it is.
+func (o *Parser) parseConditional(line string, pos Position) (bool, error) {
+	// conditional directives never start with tab
+	if strings.HasPrefix(line, "\t") {
+		return false, nil
+	}
+	line = stripComment(line)
+
+	if m := cond_class.FindStringSubmatch(line); len(m) != 0 {
+		parent := o.conditionActive()
+
+		active := false
+		if parent {
+			var err error
+			if active, err = o.evalCondition(m[1], m[2]); err != nil {
+				return true, newError(pos, ConditionalError, err.Error())
+			}
+		}
+
+		o.conds = append(o.conds, conditional{parent, active, active, false, pos})
+		return true, nil
+	}
+
+	if m := else_class.FindStringSubmatch(line); len(m) != 0 {
+		if len(o.conds) == 0 {
+			return true, newError(pos, ConditionalError, "Else without if")
+		}
+		cond := &o.conds[len(o.conds)-1]
+		if cond.inElse {
+			return true, newError(pos, ConditionalError, "Only one else per conditional")
+		}
+
+		// else with condition, like "else ifeq (a,b)"
+		active := !cond.taken
+		if m[1] != "" {
+			c := cond_class.FindStringSubmatch(m[1])
+			if len(c) == 0 {
+				return true, newError(pos, ConditionalError, "Invalid line: "+line)
+			}
+			if active && cond.parent {
+				var err error
+				if active, err = o.evalCondition(c[1], c[2]); err != nil {
+					return true, newError(pos, ConditionalError, err.Error())
+				}
+			}
+		} else {
+			cond.inElse = true
+		}
+
+		cond.active = active
+		cond.taken = cond.taken || active
+		return true, nil
+	}
+
+	if endif_class.MatchString(line) {
+		if len(o.conds) == 0 {
+			return true, newError(pos, ConditionalError, "Endif without if")
+		}
+		o.conds = o.conds[:len(o.conds)-1]
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// evalCondition returns the result of the directive with args.
+func (o *Parser) evalCondition(directive, args string) (bool, error) {
+	switch directive {
+	case "ifdef", "ifndef":
+		name := strings.TrimSpace(o.resolveString(args))
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return false, errors.New("Invalid " + directive + " " + args)
+		}
+		defined := o.varmap[name] != ""
+		return defined == (directive == "ifdef"), nil
+	default:
+		lhs, rhs, ok := splitConditionArgs(args)
+		if !ok {
+			return false, errors.New("Invalid " + directive + " " + args)
+		}
+		equal := o.resolveString(lhs) == o.resolveString(rhs)
+		return equal == (directive == "ifeq"), nil
+	}
+}
+
+// splitConditionArgs splits "(a,b)", "'a' 'b'" or "\"a\" \"b\"".
+func splitConditionArgs(args string) (string, string, bool) {
+	args = strings.TrimSpace(args)
+	if args == "" {
+		return "", "", false
+	}
+
+	if args[0] == '(' {
+		if args[len(args)-1] != ')' {
+			return "", "", false
+		}
+		args = args[1 : len(args)-1]
+
+		depth := 0
+		for i, c := range args {
+			switch c {
+			case '(', '{':
+				depth++
+			case ')', '}':
+				depth--
+			case ',':
+				if depth == 0 {
+					return strings.TrimSpace(args[:i]), strings.TrimSpace(args[i+1:]), true
+				}
+			}
+		}
+		return "", "", false
+	}
+
+	quoted := regexp.MustCompile(`^("[^"]*"|'[^']*')\s+("[^"]*"|'[^']*')$`)
+	m := quoted.FindStringSubmatch(args)
+	if len(m) == 0 {
+		return "", "", false
+	}
+	return m[1][1 : len(m[1])-1], m[2][1 : len(m[2])-1], true
+}
+
+// stripComment removes the comment at the end of a directive line.
+func stripComment(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
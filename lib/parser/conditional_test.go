@@ -0,0 +1,147 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRun_conditional(t *testing.T) {
+	tests := []struct {
+		comment  string
+		str      string
+		expected map[string]string
+	}{
+		{
+			"ifeq and else",
+			`
+MODE = debug
+ifeq ($(MODE),debug)
+FLAGS = -g
+else
+FLAGS = -O2
+endif
+`,
+			map[string]string{"MODE": "debug", "FLAGS": "-g"},
+		},
+		{
+			"ifneq with quotes",
+			`
+MODE = release
+ifneq "$(MODE)" 'debug'
+FLAGS = -O2
+endif
+`,
+			map[string]string{"MODE": "release", "FLAGS": "-O2"},
+		},
+		{
+			"ifdef and ifndef",
+			`
+EMPTY =
+DEFINED = yes
+ifdef DEFINED
+A = defined
+endif
+ifdef EMPTY
+B = defined
+endif
+ifndef UNDEFINED
+C = undefined
+endif
+`,
+			map[string]string{"EMPTY": "", "DEFINED": "yes", "A": "defined", "C": "undefined"},
+		},
+		{
+			"else ifeq chain",
+			`
+OS = darwin
+ifeq ($(OS),linux)
+EXT = so
+else ifeq ($(OS),darwin)
+EXT = dylib
+else ifeq ($(OS),darwin)
+EXT = never
+else
+EXT = dll
+endif
+`,
+			map[string]string{"OS": "darwin", "EXT": "dylib"},
+		},
+		{
+			"nested blocks",
+			`
+A = 1
+ifeq ($(A),2)
+ifeq ($(A),1)
+X = wrong
+else
+X = wrong
+endif
+else
+ifneq ($(A),2) # comment
+X = nested
+endif
+endif
+`,
+			map[string]string{"A": "1", "X": "nested"},
+		},
+	}
+
+	for _, tt := range tests {
+		parser := make_parser(strings.NewReader(tt.str))
+		if err := parser.readAndParse(); err != nil {
+			t.Errorf("%s: error happened: %q", tt.comment, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parser.varmap, tt.expected) {
+			t.Errorf("%s: expected %q to eq %q", tt.comment, parser.varmap, tt.expected)
+		}
+	}
+}
+
+func TestRun_conditionalCommands(t *testing.T) {
+	str := `
+DEBUG = 1
+all :
+ifdef DEBUG
+	echo debug
+else
+	echo release
+endif
+	echo done
+`
+	parser := make_parser(strings.NewReader(str))
+	if err := parser.readAndParse(); err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	// the lines of the branches not taken are counted
+	expected := []Rule{
+		at_lines(make_rule(
+			[]string{""},
+			[]string{"echo debug", "echo done"},
+		), 3, 5, 9),
+	}
+	if !reflect.DeepEqual(parser.rules, expected) {
+		t.Errorf("expected %v to eq %v", parser.rules, expected)
+	}
+}
+
+func TestRun_conditionalError(t *testing.T) {
+	tests := []string{
+		"ifeq (a,b)\n",
+		"else\n",
+		"endif\n",
+		"ifeq (a,b)\nelse\nelse\nendif\n",
+		"ifeq a b\nendif\n",
+		"ifdef\nendif\n",
+	}
+
+	for _, str := range tests {
+		parser := make_parser(strings.NewReader(str))
+		if err := parser.readAndParse(); err == nil {
+			t.Errorf("expected error to happen: %q", str)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	define_class   = regexp.MustCompile(`^((?:(?:override|export)\s+)*)define\s+([^\s:+?!=]+)\s*(:=|\+=|\?=|!=|=)?\s*$`)
+	endef_class    = regexp.MustCompile(`^\s*endef\s*(#.*)?$`)
+	undefine_class = regexp.MustCompile(`^(override\s+)?undefine\s+([^:=#]+?)\s*$`)
+)
+
+// parseDefine assigns the lines up to the matching endef to name.
+// Newlines in the lines are kept in the value.
+func (o *Parser) parseDefine(prefix, name, ope string) error {
+	if ope == "" {
+		ope = "="
+	}
+	pos := o.pos
+
+	// the lines are read as they are
+	o.raw = true
+	defer func() { o.raw = false }()
+
+	lines := []string{}
+	depth := 1
+	for o.inputHasNext() {
+		line := o.inputText()
+
+		if define_class.MatchString(strings.TrimLeft(line, " ")) {
+			depth++
+		} else if endef_class.MatchString(line) {
+			depth--
+			if depth == 0 {
+				return o.parseAssign(prefix+name, ope, strings.Join(lines, "\n"))
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	if o.err != nil {
+		return o.err
+	}
+	return newError(pos, SyntaxError, "Missing endef")
+}
+
+// parseUndefine removes the variable name.
+// An override variable is only removed by override.
+func (o *Parser) parseUndefine(name string, override bool) {
+	origin := originFile
+	if override {
+		origin = originOverride
+	}
+
+	if name = strings.TrimSpace(o.resolveString(name)); o.origins[name] > origin {
+		return
+	}
+
+	delete(o.varmap, name)
+	delete(o.simple, name)
+	delete(o.origins, name)
+}
+
+// splitCommand splits cmd into the commands of each line,
+// which have the prefixes of cmd in addition to their own.
+// A line continued by backslash-newline is in the same command.
+func splitCommand(cmd Command) []Command {
+	if !strings.Contains(cmd.Exestr, "\n") {
+		return []Command{cmd}
+	}
+
+	commands := []Command{}
+	lines := strings.Split(cmd.Exestr, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		for isContinued(line) && i+1 < len(lines) {
+			i++
+			line += "\n" + lines[i]
+		}
+
+		if line = strings.TrimSpace(line); line != "" {
+			commands = append(commands, parseCommandPrefix(line, cmd))
+		}
+	}
+	return commands
+}
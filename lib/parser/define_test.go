@@ -0,0 +1,137 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRun_define(t *testing.T) {
+	str := `
+A = a
+define RECURSIVE
+first $(A)
+	second
+endef
+define SIMPLE :=
+$(A)
+endef
+define SIMPLE +=
+appended
+endef
+define NESTED
+define INNER
+ifdef A
+endef
+endef
+define EMPTY
+endef
+override define O =
+o
+endef
+O = ignored
+A = b
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected := map[string]string{
+		"RECURSIVE": "first b\n\tsecond",
+		"SIMPLE":    "a appended",
+		"NESTED":    "define INNER\nifdef A\nendef",
+		"EMPTY":     "",
+		"O":         "o",
+	}
+	for name, value := range expected {
+		if result, err := mr.Expand("", nil, "$("+name+")"); err != nil || result != value {
+			t.Errorf("expected %q to eq %q", result, value)
+		}
+	}
+}
+
+func TestRun_defineRecipe(t *testing.T) {
+	str := `
+define compile
+echo compile $@
+-cc -o $@ $^
+endef
+define template
+$(1) : $(1).c
+	@echo $$@
+endef
+
+prog : a.c
+	@$(compile)
+	echo done
+$(eval $(call template,tool))
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	rule := mr.Rules[mr.Targets["prog"]]
+	auto := &Automatic{Target: "prog", Depends: rule.Depends}
+	commands := []Command{}
+	for _, cmd := range rule.Commands {
+		cmds, err := mr.ExpandCommands("prog", auto, cmd)
+		if err != nil {
+			t.Fatalf("error happened: %q", err)
+		}
+		commands = append(commands, cmds...)
+	}
+
+	// the lines of a variable are at the line referring to it
+	expected := []Command{
+		Command{Exestr: "echo compile prog", NeedEcho: false, Pos: Position{Line: 12, Column: 2}},
+		Command{Exestr: "cc -o prog a.c", NeedEcho: false, IgnoreError: true, Pos: Position{Line: 12, Column: 2}},
+		Command{Exestr: "echo done", NeedEcho: true, Pos: Position{Line: 13, Column: 2}},
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v to eq %v", commands, expected)
+	}
+
+	// the rule of eval is at the line of eval
+	rule = mr.Rules[mr.Targets["tool"]]
+	if rule.Pos != (Position{Line: 14, Column: 1}) {
+		t.Errorf("expected %v to eq %v", rule.Pos, Position{Line: 14, Column: 1})
+	}
+	if !reflect.DeepEqual(rule.Depends, []string{"tool.c"}) {
+		t.Errorf("expected %q to eq %q", rule.Depends, []string{"tool.c"})
+	}
+	expected = []Command{Command{Exestr: "echo $@", NeedEcho: false, Pos: Position{Line: 14, Column: 2}}}
+	if !reflect.DeepEqual(rule.Commands, expected) {
+		t.Errorf("expected %v to eq %v", rule.Commands, expected)
+	}
+}
+
+func TestRun_undefine(t *testing.T) {
+	str := `
+A = a
+B = b
+override C = c
+undefine A
+undefine C
+override undefine B
+D := $(A)$(C)
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	for _, name := range []string{"A", "B"} {
+		if _, ok := mr.Variables[name]; ok {
+			t.Errorf("expected %q not to be defined", name)
+		}
+	}
+	if mr.Variables["C"] != "c" || mr.Variables["D"] != "c" {
+		t.Errorf("expected (%q, %q) to eq (%q, %q)", mr.Variables["C"], mr.Variables["D"], "c", "c")
+	}
+
+	if _, err := Parse(strings.NewReader("define A\na\n")); err == nil {
+		t.Errorf("expected missing endef to be an error")
+	}
+}
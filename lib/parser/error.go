@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"fmt"
+)
+
+// Position is a location in a makefile. Line and Column start at 1.
+type Position struct {
+	File   string // empty when not read from a file
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("line %d", p.Line)
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// ErrorKind is the category of Error.
+type ErrorKind int
+
+const (
+	SyntaxError      ErrorKind = iota // malformed line
+	ConditionalError                  // unbalanced or invalid conditional directive
+	IncludeError                      // include file not found or included cyclically
+	EvalError                         // $(eval) expanded after reading the makefile
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case SyntaxError:
+		return "syntax error"
+	case ConditionalError:
+		return "conditional error"
+	case IncludeError:
+		return "include error"
+	case EvalError:
+		return "eval error"
+	}
+	return "error"
+}
+
+// Error is an error in a makefile with its position.
+type Error struct {
+	Position
+	Kind    ErrorKind
+	Message string
+}
+
+func newError(pos Position, kind ErrorKind, message string) *Error {
+	return &Error{pos, kind, message}
+}
+
+func (e *Error) Error() string {
+	return e.Position.String() + ": " + e.Message
+}
+
+// Warning is a problem in a makefile which does not stop parsing,
+// such as a recipe overridden by another rule.
+type Warning struct {
+	Position
+	Message string
+}
+
+func newWarning(pos Position, message string) *Warning {
+	return &Warning{pos, message}
+}
+
+func (w *Warning) String() string {
+	return w.Position.String() + ": " + w.Message
+}
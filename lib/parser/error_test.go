@@ -0,0 +1,112 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRun_Error(t *testing.T) {
+	tests := []struct {
+		str      string
+		line     int
+		column   int
+		kind     ErrorKind
+		expected string
+	}{
+		{"A = a\n\nnot a rule\n", 3, 1, SyntaxError, "Makefile:3: Invalid line: not a rule"},
+		{"all:\n\techo \\\n\t  a\n  bad\n", 4, 3, SyntaxError, "Makefile:4: Invalid line: bad"},
+		{"ifdef A\nall:\n", 1, 1, ConditionalError, "Makefile:1: Missing endif"},
+		{"all:\n  else\n", 2, 3, ConditionalError, "Makefile:2: Else without if"},
+		{"define A\na\n", 1, 1, SyntaxError, "Makefile:1: Missing endef"},
+		{"\ninclude missing.mk\n", 2, 1, IncludeError, "Makefile:2: Not found include file missing.mk"},
+		{"all:\n$(eval x)\n", 2, 1, SyntaxError, "Makefile:2: Invalid line: x"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.str), FileName("Makefile"))
+
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: expected %v to be *Error", tt.str, err)
+			continue
+		}
+		if e.File != "Makefile" || e.Line != tt.line || e.Column != tt.column || e.Kind != tt.kind {
+			t.Errorf("%q: expected (%v, %v) to eq (%d:%d, %v)", tt.str, e.Position, e.Kind, tt.line, tt.column, tt.kind)
+		}
+		if e.Error() != tt.expected {
+			t.Errorf("expected %q to eq %q", e.Error(), tt.expected)
+		}
+	}
+}
+
+func TestRun_positions(t *testing.T) {
+	str := `
+define recipe
+echo 1
+echo 2
+endef
+
+all : \
+      dep
+	@echo all \
+	  continued
+	# comment
+	$(recipe)
+%.o : %.c
+	cc $<
+`
+	mr, err := Parse(strings.NewReader(str), FileName("Makefile"))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	rule := mr.Rules[mr.Targets["all"]]
+	if rule.Pos != (Position{"Makefile", 7, 1}) {
+		t.Errorf("expected %v to eq %v", rule.Pos, Position{"Makefile", 7, 1})
+	}
+
+	commands := []Command{}
+	for _, cmd := range rule.Commands {
+		cmds, err := mr.ExpandCommands("all", &Automatic{Target: "all"}, cmd)
+		if err != nil {
+			t.Fatalf("error happened: %q", err)
+		}
+		commands = append(commands, cmds...)
+	}
+
+	lines := []int{9, 12, 12}
+	if len(commands) != len(lines) {
+		t.Fatalf("expected %v to have %d commands", commands, len(lines))
+	}
+	for i, cmd := range commands {
+		if cmd.Pos.Line != lines[i] {
+			t.Errorf("%q: expected %d to eq %d", cmd.Exestr, cmd.Pos.Line, lines[i])
+		}
+	}
+
+	rule = mr.Rules[mr.Patterns[0].Rule]
+	if rule.Pos.Line != 13 || rule.Commands[0].Pos.Line != 14 {
+		t.Errorf("expected (%d, %d) to eq (13, 14)", rule.Pos.Line, rule.Commands[0].Pos.Line)
+	}
+}
+
+func TestRun_warnings(t *testing.T) {
+	str := "a:\n\techo 1\nb:\na: c\n\techo 2\n"
+	mr, err := Parse(strings.NewReader(str), FileName("Makefile"))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected := []string{
+		"Makefile:4: Overriding recipe for target a",
+		"Makefile:1: Ignoring old recipe for target a",
+	}
+	if len(mr.Warnings) != len(expected) {
+		t.Fatalf("expected %v to have %d warnings", mr.Warnings, len(expected))
+	}
+	for i, w := range mr.Warnings {
+		if w.String() != expected[i] {
+			t.Errorf("expected %q to eq %q", w, expected[i])
+		}
+	}
+}
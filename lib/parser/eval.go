@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"errors"
+	"strings"
+)
+
+func init() {
+	registerFunction("eval", 1, funcEval)
+}
+
+// errEval is the error of $(eval) expanded after reading the makefile.
+var errEval = errors.New("$(eval) is not supported after reading the makefile")
+
+// $(eval text)
+func funcEval(e *expander, args []string) string {
+	if e.eval == nil {
+		if e.err == nil {
+			e.err = errEval
+		}
+		return ""
+	}
+
+	e.eval(args[0])
+	return ""
+}
+
+// evalText parses text as the makefile lines at the current position.
+// It is done only while reading the makefile, and is an error at
+// the position of the rule expanded after that.
+func (o *Parser) evalText(text string) {
+	if o.err != nil {
+		return
+	}
+	if len(o.inputs) == 0 {
+		o.err = newError(o.pos, EvalError, errEval.Error())
+		return
+	}
+
+	// read only text with its own conditionals
+	floor, buffer, conds := o.floor, o.buffer, o.conds
+	o.inputPush(strings.NewReader(text), "", o.inputs[len(o.inputs)-1].chain)
+	o.inputs[len(o.inputs)-1].pos = o.pos
+	o.inputs[len(o.inputs)-1].fixed = true
+	o.floor, o.buffer, o.conds = len(o.inputs)-1, []sourceLine{}, []conditional{}
+
+	if err := o.readAndParse(); err != nil {
+		o.err = err
+	}
+
+	o.floor, o.buffer, o.conds = floor, buffer, conds
+}
+
+// isReferenceLine reports whether line consists of references only,
+// such as $(eval ...) to be expanded before parsing.
+func isReferenceLine(line string) bool {
+	found := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ', '\t':
+			continue
+		case '$':
+			if i+1 == len(line) || (line[i+1] != '(' && line[i+1] != '{') {
+				return false
+			}
+			end := closingBracket(line, i+1)
+			if end < 0 {
+				return false
+			}
+			i, found = end, true
+		default:
+			return false
+		}
+	}
+	return found
+}
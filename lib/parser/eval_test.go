@@ -0,0 +1,96 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRun_eval(t *testing.T) {
+	str := `
+BINS = foo bar
+rule = $(1) : $(1).o lib.a
+$(foreach b,$(BINS),$(eval $(call rule,$(b))))
+
+$(eval A = 1) $(eval B := $(A)2)
+$(eval C = 3)
+ifeq ($(C),3)
+$(eval $(if $(C),D = 4))
+endif
+
+all : $(BINS)
+	@echo $(A) $(B) $(C) $(D)
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected := map[string]string{"A": "1", "B": "12", "C": "3", "D": "4"}
+	for name, value := range expected {
+		if mr.Variables[name] != value {
+			t.Errorf("expected %q to eq %q", mr.Variables[name], value)
+		}
+	}
+
+	order := []string{"foo", "bar", "all"}
+	if !reflect.DeepEqual(mr.Order, order) {
+		t.Errorf("expected %q to eq %q", mr.Order, order)
+	}
+
+	depends := mr.Rules[mr.Targets["bar"]].Depends
+	if !reflect.DeepEqual(depends, []string{"bar.o", "lib.a"}) {
+		t.Errorf("expected %q to eq %q", depends, []string{"bar.o", "lib.a"})
+	}
+
+	commands := mr.Rules[mr.Targets["all"]].Commands
+	if len(commands) != 1 {
+		t.Fatalf("expected %v to have 1 command", commands)
+	}
+	cmd, err := mr.ExpandCommand("all", &Automatic{Target: "all"}, commands[0])
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if cmd.Exestr != "echo 1 12 3 4" {
+		t.Errorf("expected %q to eq %q", cmd.Exestr, "echo 1 12 3 4")
+	}
+}
+
+func TestRun_evalError(t *testing.T) {
+	tests := []struct {
+		str, expected string
+	}{
+		{"$(eval not a rule)\n", "line 1: Invalid line: not a rule"},
+		{"all:\n$(eval ifdef A)\n", "line 2: Missing endif"},
+		{"\nall : $(eval X = 1)\nother :\n", "line 2: $(eval) is not supported after reading the makefile"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.str))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("expected %v to eq %q", err, tt.expected)
+		}
+	}
+}
+
+func TestRun_evalRecipe(t *testing.T) {
+	str := `
+all :
+	@echo $(eval Y = set)[$(Y)]
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	rule := mr.Rules[mr.Targets["all"]]
+	_, err = mr.ExpandCommands("all", &Automatic{Target: "all"}, rule.Commands[0])
+
+	expected := "line 3: $(eval) is not supported after reading the makefile"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %v to eq %q", err, expected)
+	}
+	if e, ok := err.(*Error); !ok || e.Kind != EvalError {
+		t.Errorf("expected %v to be %v", err, EvalError)
+	}
+}
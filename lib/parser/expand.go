@@ -0,0 +1,276 @@
+package parser
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+)
+
+import (
+	"github.com/hidez8891/gomk/lib/runner"
+)
+
+// expander substitutes variable references in a string.
+//
+// When deferred is set, references to the names it accepts are left as
+// they are, and the other "$" in the result are escaped as "$$", so that
+// the result can be expanded again later in the context of a target.
+type expander struct {
+	lookup    func(name string) (string, bool)
+	simple    func(name string) bool // simply expanded variables, not expanded again
+	deferred  func(name string) bool
+	expanding map[string]bool
+	fsys      fs.FS // file system of the file name functions
+	shell     func(command string) (string, int)
+	eval      func(text string)
+	kept      bool  // a deferred reference is kept
+	err       error // the first error of the functions
+}
+
+func newExpander(lookup func(string) (string, bool), deferred func(string) bool) *expander {
+	return &expander{
+		lookup:    lookup,
+		deferred:  deferred,
+		expanding: map[string]bool{},
+		fsys:      osFS{},
+		shell: func(command string) (string, int) {
+			return runShell(runner.DefaultShell(), command, os.Stderr)
+		},
+	}
+}
+
+func (e *expander) expand(str string) string {
+	if !strings.Contains(str, "$") {
+		return str
+	}
+
+	var res strings.Builder
+	for i := 0; i < len(str); {
+		if str[i] != '$' || i+1 == len(str) {
+			res.WriteByte(str[i])
+			i++
+			continue
+		}
+
+		switch next := str[i+1]; next {
+		case '$':
+			if e.deferred != nil {
+				res.WriteString("$$")
+			} else {
+				res.WriteByte('$')
+			}
+			i += 2
+		case '(', '{':
+			end := closingBracket(str, i+1)
+			if end < 0 {
+				// unterminated reference
+				res.WriteString(str[i:])
+				i = len(str)
+				break
+			}
+			res.WriteString(e.bracket(str[i:end+1], str[i+2:end]))
+			i = end + 1
+		default:
+			res.WriteString(e.reference(str[i:i+2], str[i+1:i+2]))
+			i += 2
+		}
+	}
+
+	return res.String()
+}
+
+// bracket returns the value of the reference ref in brackets with
+// the body str, which is a function call, a substitution reference
+// or a variable name.
+func (e *expander) bracket(ref, str string) string {
+	if name, args, ok := lookupFunction(str); ok {
+		return e.call(ref, name, args)
+	}
+	if name, from, to, ok := splitSubstRef(str); ok {
+		return e.substRef(ref, name, from, to)
+	}
+	return e.reference(ref, str)
+}
+
+// call returns the result of the function name with the arguments str.
+// In deferred mode, a call depending on the deferred references is kept
+// as ref, to be called again later.
+func (e *expander) call(ref, name, str string) string {
+	fn := functions[name]
+
+	kept := e.kept
+	e.kept = false
+
+	args := splitArgs(str, fn.args)
+	if !fn.lazy {
+		for i := range args {
+			args[i] = e.expand(args[i])
+		}
+	}
+
+	// lazy functions expand the arguments in fn.call,
+	// and the others are given the un-escaped arguments
+	res := ""
+	if !e.kept && fn.lazy {
+		res = fn.call(e, args)
+	} else if !e.kept {
+		for i := range args {
+			args[i] = e.unescape(args[i])
+		}
+		res = e.escape(fn.call(e, args))
+	}
+	if e.kept {
+		res = ref
+	}
+
+	e.kept = e.kept || kept
+	return res
+}
+
+// substRef returns the value of the substitution reference $(name:from=to).
+func (e *expander) substRef(ref, name, from, to string) string {
+	if strings.Contains(name, "$") {
+		name = e.expand(name)
+	}
+	if e.deferred != nil && e.deferred(name) {
+		e.kept = true
+		return ref
+	}
+
+	val := e.reference(ref, name)
+	from, to = e.expand(from), e.expand(to)
+	if !strings.Contains(from, "%") {
+		from, to = "%"+from, "%"+to
+	}
+	return patsubst(from, to, val)
+}
+
+// splitSubstRef splits the substitution reference body str "name:from=to".
+func splitSubstRef(str string) (name, from, to string, ok bool) {
+	depth, colon := 0, -1
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ':':
+			if depth == 0 && colon < 0 {
+				colon = i
+			}
+		case '=':
+			if depth == 0 && colon >= 0 {
+				return str[:colon], str[colon+1 : i], str[i+1:], true
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+// reference returns the value of the reference ref to the variable name.
+func (e *expander) reference(ref, name string) string {
+	if strings.Contains(name, "$") {
+		name = e.expand(name)
+	}
+
+	if e.deferred != nil && e.deferred(name) {
+		e.kept = true
+		return ref
+	}
+
+	val, ok := e.lookup(name)
+	if !ok || e.expanding[name] {
+		// undefined or self-referenced variable is empty
+		return ""
+	}
+	if e.simple != nil && e.simple(name) {
+		return e.escape(val)
+	}
+
+	e.expanding[name] = true
+	val = e.expand(val)
+	delete(e.expanding, name)
+
+	return val
+}
+
+// expandWith returns str expanded with the variables vars
+// taking precedence over the others found by lookup.
+func (e *expander) expandWith(vars map[string]string, str string, lookup func(string) (string, bool)) string {
+	child := *e
+	child.lookup = func(name string) (string, bool) {
+		if val, ok := vars[name]; ok {
+			return val, true
+		}
+		return lookup(name)
+	}
+	if e.deferred != nil {
+		child.deferred = func(name string) bool {
+			if _, ok := vars[name]; ok {
+				return false
+			}
+			return e.deferred(name)
+		}
+	}
+
+	if e.simple != nil {
+		child.simple = func(name string) bool {
+			if _, ok := vars[name]; ok {
+				return false
+			}
+			return e.simple(name)
+		}
+	}
+
+	res := child.expand(str)
+	e.kept = e.kept || child.kept
+	if e.err == nil {
+		e.err = child.err
+	}
+	return res
+}
+
+// escape escapes "$" in str as "$$" in deferred mode.
+func (e *expander) escape(str string) string {
+	if e.deferred == nil {
+		return str
+	}
+	return escapeDollar(str)
+}
+
+// unescape reverts escape.
+func (e *expander) unescape(str string) string {
+	if e.deferred == nil {
+		return str
+	}
+	return strings.Replace(str, "$$", "$", -1)
+}
+
+// escapeDollar escapes "$" in str as "$$".
+func escapeDollar(str string) string {
+	return strings.Replace(str, "$", "$$", -1)
+}
+
+// closingBracket returns the index of the bracket closing str[open].
+// Only brackets of the same kind are counted, as make does.
+func closingBracket(str string, open int) int {
+	close := byte(')')
+	if str[open] == '{' {
+		close = '}'
+	}
+
+	depth := 0
+	for i := open; i < len(str); i++ {
+		switch str[i] {
+		case str[open]:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
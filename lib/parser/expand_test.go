@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRun_expand(t *testing.T) {
+	varmap := map[string]string{
+		"VAR1": "var1",
+		"VAR2": "$(VAR1)-2",
+		"NAME": "VAR1",
+		"SELF": "a $(SELF)",
+		"X":    "x",
+	}
+	lookup := func(name string) (string, bool) {
+		val, ok := varmap[name]
+		return val, ok
+	}
+	deferred := func(name string) bool {
+		return isAutomatic(name)
+	}
+
+	tests := []struct {
+		str, expected, deferred string
+	}{
+		{"", "", ""},
+		{"no reference", "no reference", "no reference"},
+		{"$(VAR1) ${VAR1}", "var1 var1", "var1 var1"},
+		{"$(VAR2)", "var1-2", "var1-2"},
+		{"$($(NAME))", "var1", "var1"},
+		{"$(UNDEFINED)", "", ""},
+		{"$X$(X)", "xx", "xx"},
+		{"$$(VAR1) $$X", "$(VAR1) $X", "$$(VAR1) $$X"},
+		{"end$", "end$", "end$"},
+		{"$(VAR1", "$(VAR1", "$(VAR1"},
+		{"$(SELF)", "a ", "a "},
+		{"$@ $(@D) ${<}", "  ", "$@ $(@D) ${<}"},
+		{"$(VAR1)$(@F)", "var1", "var1$(@F)"},
+	}
+
+	for _, tt := range tests {
+		if result := newExpander(lookup, nil).expand(tt.str); result != tt.expected {
+			t.Errorf("expected %q to eq %q", result, tt.expected)
+		}
+		if result := newExpander(lookup, deferred).expand(tt.str); result != tt.deferred {
+			t.Errorf("expected %q to eq %q", result, tt.deferred)
+		}
+	}
+}
+
+func TestRun_Expand(t *testing.T) {
+	str := `
+CC = cc
+CFLAGS = -O2
+COMPILE = $(CC) $(CFLAGS) -o $@ $^
+debug : CFLAGS = -g
+
+obj/a.o obj/b.o : a.c b.c a.c
+	@$(COMPILE)
+	echo $(@D) $(@F) $< $+ $?
+debug :
+	$(COMPILE) $$HOME
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	tests := []struct {
+		target   string
+		auto     Automatic
+		commands []Command
+	}{
+		{
+			"obj/a.o",
+			Automatic{"obj/a.o", []string{"a.c", "b.c", "a.c"}, []string{"b.c", "b.c"}, ""},
+			[]Command{
+				Command{Exestr: "cc -O2 -o obj/a.o a.c b.c", NeedEcho: false},
+				Command{Exestr: "echo obj a.o a.c a.c b.c a.c b.c", NeedEcho: true},
+			},
+		},
+		{
+			"obj/b.o",
+			Automatic{"obj/b.o", []string{"a.c", "b.c", "a.c"}, []string{}, ""},
+			[]Command{
+				Command{Exestr: "cc -O2 -o obj/b.o a.c b.c", NeedEcho: false},
+				Command{Exestr: "echo obj b.o a.c a.c b.c a.c ", NeedEcho: true},
+			},
+		},
+		{
+			"debug",
+			Automatic{"debug", []string{}, []string{}, ""},
+			[]Command{
+				Command{Exestr: "cc -g -o debug  $HOME", NeedEcho: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		rule := mr.Rules[mr.Targets[tt.target]]
+		for i, cmd := range rule.Commands {
+			result, err := mr.ExpandCommand(tt.target, &tt.auto, cmd)
+			if err != nil {
+				t.Fatalf("error happened: %q", err)
+			}
+			result.Pos = Position{}
+			if result != tt.commands[i] {
+				t.Errorf("expected %v to eq %v", result, tt.commands[i])
+			}
+		}
+	}
+}
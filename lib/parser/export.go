@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var export_name_class = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// cutDirective returns lhs without the leading directive word.
+func cutDirective(lhs, word string) (string, bool) {
+	if !strings.HasPrefix(lhs, word+" ") && !strings.HasPrefix(lhs, word+"\t") {
+		return lhs, false
+	}
+	return strings.TrimSpace(lhs[len(word):]), true
+}
+
+// parseExport handles export and unexport directives.
+// Without names, all variables are exported or not.
+func (o *Parser) parseExport(names string, export bool) {
+	list := o.resolveNames(names)
+	if len(list) == 0 {
+		o.exportAll = export
+		return
+	}
+
+	for _, name := range list {
+		o.exports[name] = export
+	}
+}
+
+// isExported reports whether the variable name is passed to commands.
+func (mr *MakeRule) isExported(name string) bool {
+	if export, ok := mr.Exports[name]; ok {
+		return export
+	}
+	return mr.ExportAll && export_name_class.MatchString(name)
+}
+
+// Environ returns the environment of the commands of target.
+// The exported variables replace the entries of environ,
+// and the unexported ones are removed from it.
+// The values imported from the environment and the simply expanded
+// values are passed unexpanded.
+func (mr *MakeRule) Environ(target string, auto *Automatic, environ []string) ([]string, error) {
+	names := []string{}
+	for name := range mr.Variables {
+		names = append(names, name)
+	}
+	for name := range mr.TargetVariables[target] {
+		if _, ok := mr.Variables[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	res := []string{}
+	for _, env := range environ {
+		name := env
+		if i := strings.Index(env, "="); i > 0 {
+			name = env[:i]
+		}
+
+		_, defined := mr.Variable(target, name)
+		if export, ok := mr.Exports[name]; (ok && !export) || (defined && mr.isExported(name)) {
+			continue
+		}
+		res = append(res, env)
+	}
+
+	for _, name := range names {
+		if !mr.isExported(name) {
+			continue
+		}
+
+		val, _ := mr.Variable(target, name)
+		if _, ok := mr.TargetVariables[target][name]; (ok || !mr.environment[name]) && !mr.IsSimple(target, name) {
+			var err error
+			if val, err = mr.Expand(target, auto, val); err != nil {
+				return nil, errors.New(name + ": " + err.Error())
+			}
+		}
+		res = append(res, name+"="+val)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,24 @@
+package parser
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// osFS is the file system of the OS.
+// Unlike os.DirFS, it accepts absolute paths and paths out of
+// the current directory as make does.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"strings"
+)
+
+// function is a built-in function called as $(name arg,...).
+type function struct {
+	args int  // the number of arguments, the last one takes the rest
+	lazy bool // arguments are passed unexpanded
+	call func(e *expander, args []string) string
+}
+
+// functions is the registry of the built-in functions.
+var functions = map[string]*function{}
+
+// registerFunction adds the built-in function name taking args arguments.
+// With args 0, the number of arguments is not limited.
+func registerFunction(name string, args int, call func(*expander, []string) string) {
+	functions[name] = &function{args, false, call}
+}
+
+// registerLazyFunction adds the built-in function name which expands
+// its arguments by itself.
+func registerLazyFunction(name string, args int, call func(*expander, []string) string) {
+	functions[name] = &function{args, true, call}
+}
+
+// lookupFunction returns the name of the function called by
+// the reference body str, and the text of its arguments.
+func lookupFunction(str string) (string, string, bool) {
+	i := strings.IndexAny(str, " \t")
+	if i <= 0 {
+		return "", "", false
+	}
+
+	if _, ok := functions[str[:i]]; !ok {
+		return "", "", false
+	}
+	return str[:i], strings.TrimLeft(str[i:], " \t"), true
+}
+
+// splitArgs splits str into n arguments at the commas not in references.
+// Missing arguments are empty. With n 0, str is split at every comma.
+func splitArgs(str string, n int) []string {
+	args := []string{}
+
+	depth, start := 0, 0
+	for i := 0; i < len(str) && (n <= 0 || len(args) < n-1); i++ {
+		switch str[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, str[start:i])
+				start = i + 1
+			}
+		}
+	}
+	args = append(args, str[start:])
+
+	for len(args) < n {
+		args = append(args, "")
+	}
+	return args
+}
+
+// matchWord reports whether word matches pattern, in which the first '%'
+// matches any string, and returns the matched string.
+func matchWord(pattern, word string) (string, bool) {
+	i := strings.Index(pattern, "%")
+	if i < 0 {
+		return "", pattern == word
+	}
+
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(word) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	if !strings.HasPrefix(word, prefix) || !strings.HasSuffix(word, suffix) {
+		return "", false
+	}
+	return word[len(prefix) : len(word)-len(suffix)], true
+}
+
+// patsubst replaces the words of text matching pattern with replacement.
+func patsubst(pattern, replacement, text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		stem, ok := matchWord(pattern, word)
+		if !ok {
+			continue
+		}
+		if strings.Contains(pattern, "%") {
+			words[i] = strings.Replace(replacement, "%", stem, 1)
+		} else {
+			words[i] = replacement
+		}
+	}
+	return strings.Join(words, " ")
+}
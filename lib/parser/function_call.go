@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerLazyFunction("call", 0, funcCall)
+	registerLazyFunction("foreach", 3, funcForeach)
+	registerLazyFunction("if", 3, funcIf)
+	registerLazyFunction("or", 0, funcOr)
+	registerLazyFunction("and", 0, funcAnd)
+}
+
+// $(call variable,param,...)
+// The parameters are referred as $(1), $(2), ... and the name as $(0).
+func funcCall(e *expander, args []string) string {
+	name := strings.TrimSpace(e.expand(args[0]))
+	val, ok := e.lookup(name)
+	if !ok {
+		return ""
+	}
+	if e.simple != nil && e.simple(name) {
+		// a simple value has no parameters to refer
+		return e.escape(val)
+	}
+
+	params := map[string]string{"0": name}
+	for i, arg := range args[1:] {
+		params[strconv.Itoa(i+1)] = e.expand(arg)
+	}
+
+	// parameters of the outer call are not seen
+	lookup := e.lookup
+	return e.expandWith(params, val, func(name string) (string, bool) {
+		if _, err := strconv.Atoi(name); err == nil {
+			return "", false
+		}
+		return lookup(name)
+	})
+}
+
+// $(foreach var,list,text)
+func funcForeach(e *expander, args []string) string {
+	name := strings.TrimSpace(e.expand(args[0]))
+
+	res := []string{}
+	for _, word := range strings.Fields(e.expand(args[1])) {
+		res = append(res, e.expandWith(map[string]string{name: word}, args[2], e.lookup))
+	}
+	return strings.Join(res, " ")
+}
+
+// $(if condition,then-part[,else-part])
+func funcIf(e *expander, args []string) string {
+	if strings.TrimSpace(e.expand(args[0])) != "" {
+		return e.expand(args[1])
+	}
+	return e.expand(args[2])
+}
+
+// $(or condition1[,condition2[,condition3...]])
+func funcOr(e *expander, args []string) string {
+	for _, arg := range args {
+		if res := strings.TrimSpace(e.expand(arg)); res != "" {
+			return res
+		}
+	}
+	return ""
+}
+
+// $(and condition1[,condition2[,condition3...]])
+func funcAnd(e *expander, args []string) string {
+	res := ""
+	for _, arg := range args {
+		if res = strings.TrimSpace(e.expand(arg)); res == "" {
+			return ""
+		}
+	}
+	return res
+}
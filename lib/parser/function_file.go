@@ -0,0 +1,138 @@
+package parser
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerFunction("wildcard", 1, funcWildcard)
+	registerFunction("dir", 1, funcDir)
+	registerFunction("notdir", 1, funcNotdir)
+	registerFunction("suffix", 1, funcSuffix)
+	registerFunction("basename", 1, funcBasename)
+	registerFunction("addsuffix", 2, funcAddsuffix)
+	registerFunction("addprefix", 2, funcAddprefix)
+	registerFunction("join", 2, funcJoin)
+	registerFunction("realpath", 1, funcRealpath)
+	registerFunction("abspath", 1, funcAbspath)
+}
+
+// mapWords returns the words of text converted by f.
+// A word converted to the empty string is removed.
+func mapWords(text string, f func(string) string) string {
+	res := []string{}
+	for _, word := range strings.Fields(text) {
+		if word = f(word); word != "" {
+			res = append(res, word)
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+// splitSuffix splits word into the name and the suffix
+// beginning at the last dot of the file name part.
+func splitSuffix(word string) (string, string) {
+	i := strings.LastIndex(word, ".")
+	if i < 0 || strings.LastIndex(word, "/") > i {
+		return word, ""
+	}
+	return word[:i], word[i:]
+}
+
+// $(wildcard pattern...)
+func funcWildcard(e *expander, args []string) string {
+	res := []string{}
+	for _, pattern := range strings.Fields(args[0]) {
+		if files, err := fs.Glob(e.fsys, pattern); err == nil {
+			res = append(res, files...)
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+// $(dir names...)
+func funcDir(e *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		if i := strings.LastIndex(word, "/"); i >= 0 {
+			return word[:i+1]
+		}
+		return "./"
+	})
+}
+
+// $(notdir names...)
+func funcNotdir(e *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		return word[strings.LastIndex(word, "/")+1:]
+	})
+}
+
+// $(suffix names...)
+func funcSuffix(e *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		_, suffix := splitSuffix(word)
+		return suffix
+	})
+}
+
+// $(basename names...)
+func funcBasename(e *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		name, _ := splitSuffix(word)
+		return name
+	})
+}
+
+// $(addsuffix suffix,names...)
+func funcAddsuffix(e *expander, args []string) string {
+	return mapWords(args[1], func(word string) string {
+		return word + args[0]
+	})
+}
+
+// $(addprefix prefix,names...)
+func funcAddprefix(e *expander, args []string) string {
+	return mapWords(args[1], func(word string) string {
+		return args[0] + word
+	})
+}
+
+// $(join list1,list2)
+func funcJoin(e *expander, args []string) string {
+	list1, list2 := strings.Fields(args[0]), strings.Fields(args[1])
+	for len(list1) < len(list2) {
+		list1 = append(list1, "")
+	}
+
+	for i := range list2 {
+		list1[i] += list2[i]
+	}
+	return strings.Join(list1, " ")
+}
+
+// $(realpath names...)
+// Symbolic links are resolved only in the file system of the OS.
+func funcRealpath(e *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		if _, err := fs.Stat(e.fsys, word); err != nil {
+			return ""
+		}
+
+		abs := absPath(word)
+		if _, ok := e.fsys.(osFS); ok {
+			if real, err := filepath.EvalSymlinks(abs); err == nil {
+				return filepath.ToSlash(real)
+			}
+		}
+		return filepath.ToSlash(abs)
+	})
+}
+
+// $(abspath names...)
+func funcAbspath(e *expander, args []string) string {
+	return mapWords(args[0], func(word string) string {
+		return filepath.ToSlash(absPath(word))
+	})
+}
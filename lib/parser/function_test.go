@@ -0,0 +1,443 @@
+package parser
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRun_textFunctions(t *testing.T) {
+	varmap := map[string]string{
+		"SRCS":  "a.c b.c dir/c.c d.h",
+		"EMPTY": "",
+		"COMMA": ",",
+	}
+	lookup := func(name string) (string, bool) {
+		val, ok := varmap[name]
+		return val, ok
+	}
+
+	tests := []struct {
+		str, expected string
+	}{
+		{"$(subst ee,EE,feet on the street)", "fEEt on the strEEt"},
+		{"$(subst $(COMMA), ,a,b,c)", "a b c"},
+		{"$(subst ,x,abc)", "abc"},
+		{"$(patsubst %.c,%.o,$(SRCS))", "a.o b.o dir/c.o d.h"},
+		{"$(patsubst dir/%,%,$(SRCS))", "a.c b.c c.c d.h"},
+		{"$(patsubst a.c,x,a.c  a.cc)", "x a.cc"},
+		{"$(patsubst %,x%y,a b)", "xay xby"},
+		{"$(strip   a   b  c  )", "a b c"},
+		{"$(strip $(EMPTY))", ""},
+		{"$(findstring a,a b c)", "a"},
+		{"$(findstring x,a b c)", ""},
+		{"$(filter %.c %.h,$(SRCS) e.s)", "a.c b.c dir/c.c d.h"},
+		{"$(filter b.c,$(SRCS))", "b.c"},
+		{"$(filter-out %.c,$(SRCS))", "d.h"},
+		{"$(filter-out a.c d.h,$(SRCS))", "b.c dir/c.c"},
+		{"$(sort foo bar lose foo)", "bar foo lose"},
+		{"$(word 2,foo bar baz)", "bar"},
+		{"$(word 4,foo bar baz)", ""},
+		{"$(word 0,foo bar baz)", ""},
+		{"$(wordlist 2,3,foo bar baz)", "bar baz"},
+		{"$(wordlist 2,5,foo bar baz)", "bar baz"},
+		{"$(wordlist 3,2,foo bar baz)", ""},
+		{"$(words $(SRCS))", "4"},
+		{"$(words )", "0"},
+		{"$(firstword foo bar baz)", "foo"},
+		{"$(lastword foo bar baz)", "baz"},
+		{"$(lastword )", ""},
+		{"$(words $(filter %.c,$(SRCS)))", "3"},
+		{"${sort b a}", "a b"},
+		{"$(SRCS:.c=.o)", "a.o b.o dir/c.o d.h"},
+		{"$(SRCS:%.c=obj/%.o)", "obj/a.o obj/b.o obj/dir/c.o d.h"},
+		{"${SRCS:.h=}", "a.c b.c dir/c.c d"},
+		{"$(UNDEFINED:.c=.o)", ""},
+		{"$(sort)", ""},
+	}
+
+	for _, tt := range tests {
+		if result := newExpander(lookup, nil).expand(tt.str); result != tt.expected {
+			t.Errorf("%s: expected %q to eq %q", tt.str, result, tt.expected)
+		}
+	}
+}
+
+func TestRun_deferredFunctions(t *testing.T) {
+	varmap := map[string]string{
+		"SRCS":  "a.c b.c",
+		"COMMA": ",",
+	}
+	lookup := func(name string) (string, bool) {
+		val, ok := varmap[name]
+		return val, ok
+	}
+	deferred := func(name string) bool {
+		return isAutomatic(name)
+	}
+
+	tests := []struct {
+		str, expected string
+	}{
+		{"$(patsubst %.c,%.o,$(SRCS))", "a.o b.o"},
+		{"$(patsubst %.c,%.o,$^ $(SRCS))", "$(patsubst %.c,%.o,$^ $(SRCS))"},
+		{"$(subst $(COMMA),-,a$(COMMA)b$@)", "$(subst $(COMMA),-,a$(COMMA)b$@)"},
+		{"$(subst $(COMMA),-,a$(COMMA)b)", "a-b"},
+		{"$(words $(filter %.c,$^))", "$(words $(filter %.c,$^))"},
+		{"$(^:.c=.o)", "$(^:.c=.o)"},
+		{"$(subst a,b,$$a)", "$$b"},
+	}
+
+	for _, tt := range tests {
+		if result := newExpander(lookup, deferred).expand(tt.str); result != tt.expected {
+			t.Errorf("%s: expected %q to eq %q", tt.str, result, tt.expected)
+		}
+	}
+}
+
+func TestRun_ExpandFunctions(t *testing.T) {
+	str := `
+OBJS := $(patsubst %.c,%.o,a.c b.c)
+COMMA := ,
+JOINED = $(subst $(COMMA),-,a$(COMMA)b$@)
+prog : $(OBJS:.o=.c)
+	@echo $(OBJS) $(^:.c=.o) $(words $^)
+	@echo $(JOINED)
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	rule := mr.Rules[mr.Targets["prog"]]
+	expected := []string{"a.c", "b.c"}
+	if !reflect.DeepEqual(rule.Depends, expected) {
+		t.Errorf("expected %q to eq %q", rule.Depends, expected)
+	}
+
+	auto := &Automatic{Target: "prog", Depends: rule.Depends}
+	cmd, err := mr.ExpandCommand("prog", auto, rule.Commands[0])
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if cmd.Exestr != "echo a.o b.o a.o b.o 2" {
+		t.Errorf("expected %q to eq %q", cmd.Exestr, "echo a.o b.o a.o b.o 2")
+	}
+
+	// a deferred call keeps the commas in the arguments
+	cmd, err = mr.ExpandCommand("prog", auto, rule.Commands[1])
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if cmd.Exestr != "echo a-bprog" {
+		t.Errorf("expected %q to eq %q", cmd.Exestr, "echo a-bprog")
+	}
+}
+
+func TestRun_fileFunctions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"src/a.go":      &fstest.MapFile{},
+		"src/b.go":      &fstest.MapFile{},
+		"src/b_test.go": &fstest.MapFile{},
+		"src/doc.txt":   &fstest.MapFile{},
+		"README":        &fstest.MapFile{},
+	}
+	lookup := func(name string) (string, bool) {
+		return "", false
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	wd = filepath.ToSlash(wd)
+
+	tests := []struct {
+		str, expected string
+	}{
+		{"$(wildcard src/*.go)", "src/a.go src/b.go src/b_test.go"},
+		{"$(wildcard src/*.txt README missing)", "src/doc.txt README"},
+		{"$(wildcard src/*.c)", ""},
+		{"$(filter-out %_test.go,$(wildcard src/*.go))", "src/a.go src/b.go"},
+		{"$(dir src/foo.c hacks)", "src/ ./"},
+		{"$(notdir src/foo.c hacks)", "foo.c hacks"},
+		{"$(suffix src/foo.c src-1.0/bar hacks.tar.gz)", ".c .gz"},
+		{"$(basename src/foo.c src-1.0/bar hacks.tar.gz)", "src/foo src-1.0/bar hacks.tar"},
+		{"$(addsuffix .c,foo bar)", "foo.c bar.c"},
+		{"$(addprefix src/,foo bar)", "src/foo src/bar"},
+		{"$(join a b,.c .o)", "a.c b.o"},
+		{"$(join a b c,.c)", "a.c b c"},
+		{"$(join a,.c .o)", "a.c .o"},
+		{"$(abspath src/../a.go)", wd + "/a.go"},
+		{"$(realpath src/a.go missing README)", wd + "/src/a.go " + wd + "/README"},
+	}
+
+	for _, tt := range tests {
+		e := newExpander(lookup, nil)
+		e.fsys = fsys
+		if result := e.expand(tt.str); result != tt.expected {
+			t.Errorf("%s: expected %q to eq %q", tt.str, result, tt.expected)
+		}
+	}
+}
+
+func TestRun_FileSystem(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.c": &fstest.MapFile{},
+		"b.c": &fstest.MapFile{},
+	}
+	str := `
+SRCS := $(wildcard *.c)
+prog : $(SRCS:.c=.o)
+	@echo $(wildcard $(^:.o=.c))
+`
+	mr, err := Parse(strings.NewReader(str), FileSystem(fsys))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	rule := mr.Rules[mr.Targets["prog"]]
+	expected := []string{"a.o", "b.o"}
+	if !reflect.DeepEqual(rule.Depends, expected) {
+		t.Errorf("expected %q to eq %q", rule.Depends, expected)
+	}
+
+	auto := &Automatic{Target: "prog", Depends: rule.Depends}
+	cmd, err := mr.ExpandCommand("prog", auto, rule.Commands[0])
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if cmd.Exestr != "echo a.c b.c" {
+		t.Errorf("expected %q to eq %q", cmd.Exestr, "echo a.c b.c")
+	}
+}
+
+func TestRun_shellFunction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	str := `
+WORD = hello
+OUT := $(shell echo $(WORD); echo world)
+OK_STATUS := $(.SHELLSTATUS)
+NG := $(shell echo ng; exit 3)
+NG_STATUS := $(.SHELLSTATUS)
+ERR := $(shell echo parse >&2)
+LAZY = $(shell echo $@)
+prog :
+	@echo $(LAZY) $(shell printf 'a\nb\n\n')
+status :
+	@echo $(shell exit 5)$(.SHELLSTATUS) $(shell echo recipe >&2)$(.SHELLSTATUS)
+`
+	stderr := new(bytes.Buffer)
+	mr, err := Parse(strings.NewReader(str), Stderr(stderr))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected := map[string]string{
+		"OUT":       "hello world",
+		"OK_STATUS": "0",
+		"NG":        "ng",
+		"NG_STATUS": "3",
+	}
+	for name, value := range expected {
+		if mr.Variables[name] != value {
+			t.Errorf("expected %q to eq %q", mr.Variables[name], value)
+		}
+	}
+
+	rule := mr.Rules[mr.Targets["prog"]]
+	cmd, err := mr.ExpandCommand("prog", &Automatic{Target: "prog"}, rule.Commands[0])
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if cmd.Exestr != "echo prog a b " {
+		t.Errorf("expected %q to eq %q", cmd.Exestr, "echo prog a b ")
+	}
+
+	// the status of $(shell) in a recipe is seen in the same recipe
+	rule = mr.Rules[mr.Targets["status"]]
+	cmd, err = mr.ExpandCommand("status", &Automatic{Target: "status"}, rule.Commands[0])
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if cmd.Exestr != "echo 5 0" {
+		t.Errorf("expected %q to eq %q", cmd.Exestr, "echo 5 0")
+	}
+
+	if stderr.String() != "parse\nrecipe\n" {
+		t.Errorf("expected %q to eq %q", stderr.String(), "parse\nrecipe\n")
+	}
+}
+
+func TestRun_lazyShellFunction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	log := filepath.Join(t.TempDir(), "log")
+	str := `
+UNUSED = $(shell echo unused >> ` + log + `)
+USED = $(shell echo used >> ` + log + `)
+prog :
+	@echo $(USED)$(USED)
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	if _, err := os.Stat(log); !os.IsNotExist(err) {
+		t.Fatalf("expected %q not to be written while parsing", log)
+	}
+
+	// a recursive variable runs the command each time it is referred
+	rule := mr.Rules[mr.Targets["prog"]]
+	if _, err := mr.ExpandCommand("prog", &Automatic{Target: "prog"}, rule.Commands[0]); err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	out, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if string(out) != "used\nused\n" {
+		t.Errorf("expected %q to eq %q", string(out), "used\nused\n")
+	}
+}
+
+func TestRun_simpleShellFunction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	str := `
+Y = expanded
+X := $(shell printf '\044(Y)')
+PID := $(shell echo $$PPID | tr -d 0-9)
+AUTO := $(shell printf '\044(Y)') $@
+X += $(shell printf '\044\044')
+prog :
+	@echo $(X) $(PID) $(AUTO)
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	// a simple value is not expanded again
+	expected := map[string]string{
+		"X":   "$(Y) $$",
+		"PID": "",
+	}
+	for name, value := range expected {
+		if mr.Variables[name] != value {
+			t.Errorf("expected %q to eq %q", mr.Variables[name], value)
+		}
+	}
+
+	rule := mr.Rules[mr.Targets["prog"]]
+	cmd, err := mr.ExpandCommand("prog", &Automatic{Target: "prog"}, rule.Commands[0])
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if cmd.Exestr != "echo $(Y) $$  $(Y) prog" {
+		t.Errorf("expected %q to eq %q", cmd.Exestr, "echo $(Y) $$  $(Y) prog")
+	}
+}
+
+func TestRun_callFunctions(t *testing.T) {
+	varmap := map[string]string{
+		"reverse": "$(2) $(1)",
+		"map":     "$(foreach a,$(2),$(call $(1),$(a)))",
+		"obj":     "$(1).o",
+		"name":    "$(0)",
+		"rev":     "$(if $(1),$(call rev,$(wordlist 2,$(words $(1)),$(1))) $(firstword $(1)))",
+		"LIST":    "a b c",
+		"EMPTY":   "",
+		"SPACE":   " ",
+	}
+	lookup := func(name string) (string, bool) {
+		if name == "NEVER" {
+			t.Errorf("expected %q not to be expanded", name)
+		}
+		val, ok := varmap[name]
+		return val, ok
+	}
+
+	tests := []struct {
+		str, expected string
+	}{
+		{"$(call reverse,a,b)", "b a"},
+		{"$(call reverse,a)", " a"},
+		{"$(call name)", "name"},
+		{"$(call undefined,a)", ""},
+		{"$(call map,obj,x y)", "x.o y.o"},
+		{"$(strip $(call rev,$(LIST)))", "c b a"},
+		{"$(foreach f,$(LIST),$(f).c)", "a.c b.c c.c"},
+		{"$(foreach f,,$(f).c)", ""},
+		{"$(foreach f,a b,$(f)) $(f)", "a b "},
+		{"$(if $(LIST),yes,no)", "yes"},
+		{"$(if $(SPACE),yes,no)", "no"},
+		{"$(if ,yes)", ""},
+		{"$(if x,a,b,c)", "a"},
+		{"$(if x,yes,$(NEVER))", "yes"},
+		{"$(if ,$(NEVER),no)", "no"},
+		{"$(or $(EMPTY),$(SPACE), b ,$(NEVER))", "b"},
+		{"$(or $(EMPTY))", ""},
+		{"$(and a,b)", "b"},
+		{"$(and a,$(EMPTY),$(NEVER))", ""},
+	}
+
+	for _, tt := range tests {
+		if result := newExpander(lookup, nil).expand(tt.str); result != tt.expected {
+			t.Errorf("%s: expected %q to eq %q", tt.str, result, tt.expected)
+		}
+	}
+}
+
+func TestRun_deferredCallFunctions(t *testing.T) {
+	str := `
+compile = cc -o $@ $(1)
+sources = $(addsuffix .c,$(1) $(2))
+prog : $(call sources,a,b)
+	@$(call compile,$^)
+	@echo $(if $<,first $<,none)
+	@echo $(foreach f,$^,[$(f)]) $(or $(EMPTY),ok)
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	rule := mr.Rules[mr.Targets["prog"]]
+	expected := []string{
+		"$(call compile,$^)",
+		"echo $(if $<,first $<,none)",
+		"echo $(foreach f,$^,[$(f)]) $(or $(EMPTY),ok)",
+	}
+	for i, cmd := range rule.Commands {
+		if cmd.Exestr != expected[i] {
+			t.Errorf("expected %q to eq %q", cmd.Exestr, expected[i])
+		}
+	}
+
+	auto := &Automatic{Target: "prog", Depends: rule.Depends}
+	expected = []string{"cc -o prog a.c b.c", "echo first a.c", "echo [a.c] [b.c] ok"}
+	for i, cmd := range rule.Commands {
+		cmd, err = mr.ExpandCommand("prog", auto, cmd)
+		if err != nil {
+			t.Fatalf("error happened: %q", err)
+		}
+		if cmd.Exestr != expected[i] {
+			t.Errorf("expected %q to eq %q", cmd.Exestr, expected[i])
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package parser
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerFunction("subst", 3, funcSubst)
+	registerFunction("patsubst", 3, funcPatsubst)
+	registerFunction("strip", 1, funcStrip)
+	registerFunction("findstring", 2, funcFindstring)
+	registerFunction("filter", 2, funcFilter)
+	registerFunction("filter-out", 2, funcFilterOut)
+	registerFunction("sort", 1, funcSort)
+	registerFunction("word", 2, funcWord)
+	registerFunction("wordlist", 3, funcWordlist)
+	registerFunction("words", 1, funcWords)
+	registerFunction("firstword", 1, funcFirstword)
+	registerFunction("lastword", 1, funcLastword)
+}
+
+// $(subst from,to,text)
+func funcSubst(e *expander, args []string) string {
+	if args[0] == "" {
+		return args[2]
+	}
+	return strings.Replace(args[2], args[0], args[1], -1)
+}
+
+// $(patsubst pattern,replacement,text)
+func funcPatsubst(e *expander, args []string) string {
+	return patsubst(args[0], args[1], args[2])
+}
+
+// $(strip string)
+func funcStrip(e *expander, args []string) string {
+	return strings.Join(strings.Fields(args[0]), " ")
+}
+
+// $(findstring find,in)
+func funcFindstring(e *expander, args []string) string {
+	if strings.Contains(args[1], args[0]) {
+		return args[0]
+	}
+	return ""
+}
+
+// $(filter pattern...,text)
+func funcFilter(e *expander, args []string) string {
+	return filterWords(args[0], args[1], true)
+}
+
+// $(filter-out pattern...,text)
+func funcFilterOut(e *expander, args []string) string {
+	return filterWords(args[0], args[1], false)
+}
+
+// filterWords returns the words of text which match
+// any of patterns if match is true, or none of them otherwise.
+func filterWords(patterns, text string, match bool) string {
+	res := []string{}
+	for _, word := range strings.Fields(text) {
+		matched := false
+		for _, pattern := range strings.Fields(patterns) {
+			if _, ok := matchWord(pattern, word); ok {
+				matched = true
+				break
+			}
+		}
+		if matched == match {
+			res = append(res, word)
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+// $(sort list)
+func funcSort(e *expander, args []string) string {
+	words := uniqueWords(strings.Fields(args[0]))
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// $(word n,text)
+func funcWord(e *expander, args []string) string {
+	n, ok := wordIndex(args[0])
+	words := strings.Fields(args[1])
+	if !ok || n > len(words) {
+		return ""
+	}
+	return words[n-1]
+}
+
+// $(wordlist s,e,text)
+func funcWordlist(e *expander, args []string) string {
+	start, ok1 := wordIndex(args[0])
+	end, ok2 := wordIndex(args[1])
+	words := strings.Fields(args[2])
+	if !ok1 || !ok2 || start > len(words) || start > end {
+		return ""
+	}
+	if end > len(words) {
+		end = len(words)
+	}
+	return strings.Join(words[start-1:end], " ")
+}
+
+// wordIndex parses the 1-origin word index str.
+func wordIndex(str string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(str))
+	return n, err == nil && n > 0
+}
+
+// $(words text)
+func funcWords(e *expander, args []string) string {
+	return strconv.Itoa(len(strings.Fields(args[0])))
+}
+
+// $(firstword names...)
+func funcFirstword(e *expander, args []string) string {
+	words := strings.Fields(args[0])
+	if len(words) == 0 {
+		return ""
+	}
+	return words[0]
+}
+
+// $(lastword names...)
+func funcLastword(e *expander, args []string) string {
+	words := strings.Fields(args[0])
+	if len(words) == 0 {
+		return ""
+	}
+	return words[len(words)-1]
+}
@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parseInclude reads the makefiles of names before the rest of the input.
+// A missing file is an error when required, or ignored otherwise.
+func (o *Parser) parseInclude(names string, required bool) error {
+	pos := o.pos
+
+	files := []string{}
+	for _, name := range o.resolveNames(names) {
+		file, ok := o.searchInclude(name)
+		if !ok {
+			if required {
+				return newError(pos, IncludeError, "Not found include file "+name)
+			}
+			continue
+		}
+		files = append(files, file...)
+	}
+
+	// push in reverse order to read in order,
+	// each of which is included from the current input
+	chain := o.inputs[len(o.inputs)-1].chain
+	for i := len(files) - 1; i >= 0; i-- {
+		file := files[i]
+
+		for _, including := range chain {
+			if including == absPath(file) {
+				return newError(pos, IncludeError, "Include cycle "+file)
+			}
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if required {
+				return newError(pos, IncludeError, err.Error())
+			}
+			continue
+		}
+		o.inputPush(bytes.NewReader(data), file, chain)
+	}
+
+	return nil
+}
+
+// searchInclude returns the files of name. A relative name is searched
+// from the directory of the including file and the include directories.
+// A name with wildcard characters may match multiple files.
+func (o *Parser) searchInclude(name string) ([]string, bool) {
+	dirs := []string{""}
+	if !filepath.IsAbs(name) {
+		dirs = append([]string{o.inputDir()}, o.includes...)
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+
+		if strings.ContainsAny(name, "*?[") {
+			if files, err := filepath.Glob(path); err == nil && len(files) > 0 {
+				return files, true
+			}
+			continue
+		}
+
+		if _, err := os.Stat(path); err == nil {
+			return []string{path}, true
+		}
+	}
+
+	return nil, false
+}
+
+// inputDir returns the directory of the file being read.
+func (o *Parser) inputDir() string {
+	for i := len(o.inputs) - 1; i >= 0; i-- {
+		if o.inputs[i].name != "" {
+			return filepath.Dir(o.inputs[i].name)
+		}
+	}
+	return "."
+}
+
+func absPath(name string) string {
+	if path, err := filepath.Abs(name); err == nil {
+		return path
+	}
+	return filepath.Clean(name)
+}
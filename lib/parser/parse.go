@@ -4,40 +4,213 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"io/fs"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+import (
+	"github.com/hidez8891/gomk/lib/runner"
+)
+
 type MakeRule struct {
-	Targets map[string]int
-	Rules   []Rule
+	Targets         map[string]int
+	Order           []string // targets in order of definition
+	Patterns        []Pattern
+	Rules           []Rule
+	Phony           map[string]bool
+	Variables       map[string]string
+	Simple          map[string]bool // simply expanded variables, not expanded again
+	TargetVariables map[string]map[string]string
+	Exports         map[string]bool // false if unexported
+	ExportAll       bool
+	Warnings        []*Warning
+	fsys            fs.FS
+	stderr          io.Writer
+	environment     map[string]bool // variables imported from the environment
 }
 
 type Rule struct {
 	Depends  []string
 	Commands []Command
+	Pos      Position
 }
 
 type Command struct {
-	Exestr   string
-	NeedEcho bool
+	Exestr      string
+	NeedEcho    bool
+	IgnoreError bool // '-' prefix, continue on failure
+	Force       bool // '+' prefix, run even in dry-run mode
+	Pos         Position
 }
 
 type Parser struct {
+	inputs     []*input
+	buffer     []sourceLine
+	pos        Position // position of the line taken last
+	varmap     map[string]string
+	targets    map[string]int
+	entries    []entry // rules of the targets defined already
+	order      []string
+	patterns   []Pattern
+	rules      []Rule
+	phony      []string
+	targetvars map[string]map[string]string
+	simple     map[string]bool // simply expanded variables
+	origins    map[string]int
+	exports    map[string]bool
+	exportAll  bool
+	includes   []string
+	fsys       fs.FS
+	stderr     io.Writer
+	floor      int  // the number of inputs not read by eval
+	raw        bool // conditional directives are not evaluated
+	warnings   []*Warning
+	conds      []conditional
+	err        error
+}
+
+// origins of variables, in order of precedence
+const (
+	originEnvironment int = iota
+	originFile
+	originEnvironmentOverride
+	originCommandLine
+	originOverride
+)
+
+// input is a source of makefile lines.
+type input struct {
 	scanner *bufio.Scanner
-	buffer  []string
-	varmap  map[string]string
-	targets map[string]int
-	rules   []Rule
+	name    string   // file name, empty when not read from a file
+	chain   []string // absolute paths of the including files and itself
+	pos     Position // position of the line read last
+	fixed   bool     // pos is not advanced, as the text of eval
 }
 
-func Parse(r io.Reader) (mr *MakeRule, err error) {
-	o := &Parser{
-		scanner: bufio.NewScanner(r),
-		buffer:  []string{},
-		varmap:  map[string]string{},
-		targets: map[string]int{},
-		rules:   []Rule{},
+// entry is the targets of a rule as written in the makefile.
+type entry struct {
+	targets string
+	rule    int
+}
+
+// sourceLine is a line taken from input with its position.
+type sourceLine struct {
+	text string
+	pos  Position
+}
+
+// Option is an optional setting of Parse.
+type Option func(*Parser)
+
+// FileName sets the file name of the makefile read by Parse.
+// Relative include files are searched from its directory.
+func FileName(name string) Option {
+	return func(o *Parser) {
+		o.inputs[0].name = name
+		o.inputs[0].chain = []string{absPath(name)}
+		o.inputs[0].pos.File = name
+	}
+}
+
+// IncludeDirs adds the directories to search include files.
+func IncludeDirs(dirs ...string) Option {
+	return func(o *Parser) {
+		o.includes = append(o.includes, dirs...)
+	}
+}
+
+// FileSystem sets the file system used by the file name functions
+// such as $(wildcard). The default is the file system of the OS.
+func FileSystem(fsys fs.FS) Option {
+	return func(o *Parser) {
+		o.fsys = fsys
+	}
+}
+
+// Stderr sets the writer of the standard error of $(shell) commands,
+// run while parsing and expanding. The default is os.Stderr.
+func Stderr(w io.Writer) Option {
+	return func(o *Parser) {
+		o.stderr = w
+	}
+}
+
+// CommandLineVariables sets the variables given as "NAME=value" or
+// "NAME:=value". They take precedence over the makefile assignments
+// without override.
+func CommandLineVariables(assigns ...string) Option {
+	return func(o *Parser) {
+		for _, assign := range assigns {
+			i := strings.Index(assign, "=")
+			if i <= 0 {
+				continue
+			}
+
+			name, value := assign[:i], assign[i+1:]
+			simple := strings.HasSuffix(name, ":")
+			if simple {
+				name = name[:len(name)-1]
+				value, simple = o.resolveVariable(value)
+			}
+			name = strings.TrimSpace(name)
+			o.setVariable(name, value, simple, originCommandLine)
+			o.exports[name] = true
+		}
+	}
+}
+
+// Environment sets the variables of environ given as "NAME=value".
+// They are overridden by the makefile assignments unless override is true.
+// SHELL is not taken from the environment.
+func Environment(environ []string, override bool) Option {
+	origin := originEnvironment
+	if override {
+		origin = originEnvironmentOverride
+	}
+
+	return func(o *Parser) {
+		for _, env := range environ {
+			i := strings.Index(env, "=")
+			if i <= 0 || env[:i] == "SHELL" {
+				continue
+			}
+
+			o.setVariable(env[:i], env[i+1:], false, origin)
+			o.exports[env[:i]] = true
+		}
+	}
+}
+
+func newParser(r io.Reader) *Parser {
+	return &Parser{
+		inputs:     []*input{&input{scanner: bufio.NewScanner(r), chain: []string{}}},
+		buffer:     []sourceLine{},
+		varmap:     map[string]string{},
+		targets:    map[string]int{},
+		entries:    []entry{},
+		order:      []string{},
+		patterns:   []Pattern{},
+		rules:      []Rule{},
+		phony:      []string{},
+		targetvars: map[string]map[string]string{},
+		simple:     map[string]bool{},
+		origins:    map[string]int{},
+		exports:    map[string]bool{},
+		includes:   []string{},
+		fsys:       osFS{},
+		stderr:     os.Stderr,
+		conds:      []conditional{},
+	}
+}
+
+func Parse(r io.Reader, options ...Option) (mr *MakeRule, err error) {
+	o := newParser(r)
+	for _, option := range options {
+		option(o)
 	}
 
 	if err = o.readAndParse(); err != nil {
@@ -48,46 +221,237 @@ func Parse(r io.Reader) (mr *MakeRule, err error) {
 		return
 	}
 
+	phony := map[string]bool{}
+	for _, name := range o.phony {
+		phony[name] = true
+	}
+
 	mr = &MakeRule{
-		Targets: o.targets,
-		Rules:   o.rules,
+		Targets:         o.targets,
+		Order:           o.order,
+		Patterns:        o.patterns,
+		Rules:           o.rules,
+		Phony:           phony,
+		Variables:       o.varmap,
+		Simple:          map[string]bool{},
+		TargetVariables: o.targetvars,
+		Exports:         o.exports,
+		ExportAll:       o.exportAll,
+		Warnings:        o.warnings,
+		fsys:            o.fsys,
+		stderr:          o.stderr,
+		environment:     map[string]bool{},
+	}
+	for name, simple := range o.simple {
+		if simple {
+			mr.Simple[name] = true
+		}
+	}
+	for name, origin := range o.origins {
+		if origin == originEnvironment || origin == originEnvironmentOverride {
+			mr.environment[name] = true
+		}
+	}
+
+	if _, ok := mr.Variables[".DEFAULT_GOAL"]; !ok {
+		mr.Variables[".DEFAULT_GOAL"] = mr.firstTarget()
 	}
 	return
 }
 
+// DefaultGoal returns the target made when no target is given.
+// It is the value of .DEFAULT_GOAL, which is the first target
+// of the makefile unless it is assigned.
+func (mr *MakeRule) DefaultGoal() (string, error) {
+	goal, err := mr.Expand("", nil, "$(.DEFAULT_GOAL)")
+	if err != nil {
+		return "", errors.New(".DEFAULT_GOAL: " + err.Error())
+	}
+
+	if goal = strings.TrimSpace(goal); goal == "" {
+		goal = mr.firstTarget()
+	}
+	if goal == "" {
+		return "", errors.New("No targets")
+	}
+	return goal, nil
+}
+
+// firstTarget returns the first target except special targets.
+func (mr *MakeRule) firstTarget() string {
+	for _, name := range mr.Order {
+		if !strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+			return name
+		}
+	}
+	return ""
+}
+
+// IsSimple reports whether name seen by target is a simply expanded
+// variable. Target-specific values are expanded each time.
+func (mr *MakeRule) IsSimple(target, name string) bool {
+	if vars, ok := mr.TargetVariables[target]; ok {
+		if _, ok := vars[name]; ok {
+			return false
+		}
+	}
+	return mr.Simple[name]
+}
+
+// Variable returns the value of name seen by target.
+// A target-specific value takes precedence over the global one.
+func (mr *MakeRule) Variable(target, name string) (string, bool) {
+	if vars, ok := mr.TargetVariables[target]; ok {
+		if val, ok := vars[name]; ok {
+			return val, true
+		}
+	}
+
+	val, ok := mr.Variables[name]
+	return val, ok
+}
+
+// Expand returns str expanded in the context of target,
+// with the automatic variables of auto. auto may be nil.
+// Recursive variables are expanded each time they are referred,
+// and simply expanded variables are referred as they are.
+// .SHELLSTATUS refers to the exit status of the last $(shell) in str.
+// $(eval) in str is an error, since the makefile is already read.
+func (mr *MakeRule) Expand(target string, auto *Automatic, str string) (string, error) {
+	e := mr.newExpander(target, auto)
+
+	status := ""
+	lookup := e.lookup
+	e.lookup = func(name string) (string, bool) {
+		if name == ".SHELLSTATUS" && status != "" {
+			return status, true
+		}
+		return lookup(name)
+	}
+	e.shell = func(command string) (string, int) {
+		out, code := runShell(mr.Shell(target), command, mr.stderr)
+		status = strconv.Itoa(code)
+		return out, code
+	}
+
+	res := e.expand(str)
+	return res, e.err
+}
+
+// newExpander returns the expander of the variables seen by target.
+// The $(shell) function runs with the default shell.
+func (mr *MakeRule) newExpander(target string, auto *Automatic) *expander {
+	lookup := func(name string) (string, bool) {
+		if val, ok := auto.value(name); ok {
+			return val, true
+		}
+		return mr.Variable(target, name)
+	}
+
+	// the automatic variables are not expanded again
+	e := newExpander(lookup, nil)
+	e.simple = func(name string) bool {
+		if _, ok := auto.value(name); ok {
+			return true
+		}
+		return mr.IsSimple(target, name)
+	}
+	if mr.fsys != nil {
+		e.fsys = mr.fsys
+	}
+	e.shell = func(command string) (string, int) {
+		return runShell(runner.DefaultShell(), command, mr.stderr)
+	}
+	return e
+}
+
+// ExpandCommands returns cmd expanded in the context of target,
+// which is split into the commands of each line.
+func (mr *MakeRule) ExpandCommands(target string, auto *Automatic, cmd Command) ([]Command, error) {
+	res, err := mr.ExpandCommand(target, auto, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return splitCommand(res), nil
+}
+
+// ExpandCommand returns cmd expanded in the context of target.
+// An error of the expansion has the position of cmd.
+func (mr *MakeRule) ExpandCommand(target string, auto *Automatic, cmd Command) (Command, error) {
+	exestr, err := mr.Expand(target, auto, cmd.Exestr)
+	if err != nil {
+		return cmd, newError(cmd.Pos, EvalError, err.Error())
+	}
+	return parseCommandPrefix(exestr, cmd), nil
+}
+
 func (o *Parser) readAndParse() error {
-	rule_class := regexp.MustCompile(`^(.+?)\s*(:=|=|:)\s*(.*?)$`)
+	target_assign_class := regexp.MustCompile(`^([^\s:=+?]+)\s*(:=|\+=|\?=|=)\s*(.*?)$`)
+	include_class := regexp.MustCompile(`^(include|-include|sinclude)\s+([^:=\s].*?)\s*$`)
+	export_class := regexp.MustCompile(`^(export|unexport)(\s+[^:=]*?)?\s*$`)
 
 	for o.inputHasNext() {
-		line := o.inputText()
+		line := joinContinuation(o.inputText())
 
 		// skip comment line
 		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
 
-		// rule parsing
-		m := rule_class.FindStringSubmatch(line)
-		if len(m) == 0 {
-			return errors.New("Parse error: " + line)
+		// references to expand such as $(eval ...)
+		if isReferenceLine(line) {
+			if line = strings.TrimSpace(o.resolveString(line)); line == "" || o.err != nil {
+				continue
+			}
 		}
 
-		lhs := m[1]
-		ope := m[2]
-		rhs := m[3]
+		// multi-line variable
+		if m := define_class.FindStringSubmatch(line); len(m) != 0 {
+			if err := o.parseDefine(m[1], m[2], m[3]); err != nil {
+				return err
+			}
+			continue
+		}
+		if m := undefine_class.FindStringSubmatch(line); len(m) != 0 {
+			o.parseUndefine(m[2], m[1] != "")
+			continue
+		}
 
-		switch ope {
-		case ":=":
-			// immediate value assign
-			if err := o.parseAssign(lhs, rhs, true); err != nil {
+		// include directive
+		if m := include_class.FindStringSubmatch(line); len(m) != 0 {
+			if err := o.parseInclude(m[2], m[1] == "include"); err != nil {
 				return err
 			}
-		case "=":
-			// lazy value assign
-			if err := o.parseAssign(lhs, rhs, false); err != nil {
+			continue
+		}
+
+		// export directive
+		if m := export_class.FindStringSubmatch(line); len(m) != 0 {
+			o.parseExport(m[2], m[1] == "export")
+			continue
+		}
+
+		// rule parsing
+		lhs, ope, rhs, ok := splitRuleLine(line)
+		if !ok {
+			return newError(o.pos, SyntaxError, "Invalid line: "+strings.TrimSpace(line))
+		}
+
+		switch ope {
+		case ":=", "=", "+=", "?=", "!=":
+			// value assign
+			if err := o.parseAssign(lhs, ope, rhs); err != nil {
 				return err
 			}
 		case ":":
+			// target-specific value assign
+			if m := target_assign_class.FindStringSubmatch(rhs); len(m) != 0 {
+				if err := o.parseTargetAssign(lhs, m[1], m[2], m[3]); err != nil {
+					return err
+				}
+				continue
+			}
+
 			// rule description
 			if err := o.parseRule(lhs, rhs); err != nil {
 				return err
@@ -95,17 +459,154 @@ func (o *Parser) readAndParse() error {
 		}
 	}
 
+	return o.err
+}
+
+// splitRuleLine splits line at the first assignment or rule operator.
+// The operators in the references $(...) and ${...} are skipped.
+func splitRuleLine(line string) (lhs, ope, rhs string, ok bool) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '$':
+			if i+1 < len(line) && (line[i+1] == '(' || line[i+1] == '{') {
+				if end := closingBracket(line, i+1); end >= 0 {
+					i = end
+				}
+			}
+			continue
+		case ':', '+', '?', '!':
+			if i+1 < len(line) && line[i+1] == '=' {
+				ope = line[i : i+2]
+			} else if line[i] == ':' {
+				ope = ":"
+			} else {
+				continue
+			}
+		case '=':
+			ope = "="
+		default:
+			continue
+		}
+
+		if i == 0 {
+			return "", "", "", false
+		}
+		return strings.TrimSpace(line[:i]), ope, strings.TrimSpace(line[i+len(ope):]), true
+	}
+	return "", "", "", false
+}
+
+func (o *Parser) parseAssign(lhs, ope, rhs string) error {
+	lhs = strings.TrimSpace(lhs)
+	rhs = strings.TrimSpace(rhs)
+
+	origin := originFile
+	for {
+		if name, ok := cutDirective(lhs, "override"); ok {
+			origin = originOverride
+			lhs = name
+		} else if name, ok := cutDirective(lhs, "export"); ok {
+			o.exports[name] = true
+			lhs = name
+		} else {
+			break
+		}
+	}
+
+	// an override value is only changed by override
+	if o.origins[lhs] > origin {
+		return nil
+	}
+
+	switch ope {
+	case ":=":
+		// immediate value assign
+		val, simple := o.resolveVariable(rhs)
+		o.setVariable(lhs, val, simple, origin)
+	case "=":
+		// lazy value assign
+		o.setVariable(lhs, rhs, false, origin)
+	case "?=":
+		// lazy value assign if undefined
+		if _, ok := o.varmap[lhs]; ok {
+			return nil
+		}
+		o.setVariable(lhs, rhs, false, origin)
+	case "+=":
+		// append value with the same flavor
+		val, ok := o.varmap[lhs]
+		if !ok {
+			o.setVariable(lhs, rhs, false, origin)
+			break
+		}
+		simple := o.simple[lhs]
+		if simple {
+			if rhs, simple = o.resolveVariable(rhs); !simple {
+				val = escapeDollar(val)
+			}
+		}
+		if val != "" && rhs != "" {
+			val += " "
+		}
+		o.setVariable(lhs, val+rhs, simple, origin)
+	case "!=":
+		// shell output assign
+		out, _ := o.shellOutput(o.resolveString(rhs))
+		o.setVariable(lhs, out, false, origin)
+	}
+
 	return nil
 }
 
-func (o *Parser) parseAssign(lhs, rhs string, immediate bool) error {
+func (o *Parser) setVariable(name, value string, simple bool, origin int) {
+	o.varmap[name] = value
+	o.simple[name] = simple
+	o.origins[name] = origin
+}
+
+func (o *Parser) parseTargetAssign(target, lhs, ope, rhs string) error {
+	target = strings.TrimSpace(target)
 	lhs = strings.TrimSpace(lhs)
 	rhs = strings.TrimSpace(rhs)
 
-	if immediate {
-		rhs = o.resolveVariable(rhs)
+	// a value taking precedence over the makefile is not changed
+	if o.origins[lhs] > originFile {
+		return nil
 	}
-	o.varmap[lhs] = rhs
+
+	if _, ok := o.targetvars[target]; !ok {
+		o.targetvars[target] = map[string]string{}
+	}
+	vars := o.targetvars[target]
+
+	// the current value is the target-specific or global one,
+	// and target-specific values are expanded again
+	val, defined := vars[lhs]
+	if !defined {
+		if val, defined = o.varmap[lhs]; o.simple[lhs] {
+			val = escapeDollar(val)
+		}
+	}
+
+	switch ope {
+	case ":=":
+		if val, simple := o.resolveVariable(rhs); simple {
+			rhs = escapeDollar(val)
+		} else {
+			rhs = val
+		}
+	case "?=":
+		if defined {
+			return nil
+		}
+	case "+=":
+		if val != "" && rhs != "" {
+			rhs = val + " " + rhs
+		} else {
+			rhs = val + rhs
+		}
+	}
+	vars[lhs] = rhs
 
 	return nil
 }
@@ -114,15 +615,37 @@ func (o *Parser) parseRule(lhs, rhs string) error {
 	lhs = strings.TrimSpace(lhs)
 	rhs = strings.TrimSpace(rhs)
 
-	if _, exist := o.targets[lhs]; exist {
-		return errors.New("Error: Duplicate rule define " + lhs)
+	// special target, whose commands are ignored
+	if lhs == ".PHONY" {
+		o.phony = append(o.phony, rhs)
+		o.parseCommands()
+		return nil
+	}
+	if lhs == ".EXPORT_ALL_VARIABLES" {
+		o.exportAll = true
+		o.parseCommands()
+		return nil
 	}
+
+	pos := o.pos
 	target := lhs
 	depends := []string{rhs}
 	commands := o.parseCommands()
 
-	o.targets[target] = len(o.rules)
-	o.rules = append(o.rules, Rule{depends, commands})
+	// pattern rules may share the same target pattern
+	if strings.Contains(target, "%") {
+		o.patterns = append(o.patterns, Pattern{target, len(o.rules)})
+		o.rules = append(o.rules, Rule{depends, commands, pos})
+		return nil
+	}
+
+	// the rules of the same target are merged in preprocess
+	if _, exist := o.targets[target]; exist {
+		o.entries = append(o.entries, entry{target, len(o.rules)})
+	} else {
+		o.targets[target] = len(o.rules)
+	}
+	o.rules = append(o.rules, Rule{depends, commands, pos})
 
 	return nil
 }
@@ -139,120 +662,326 @@ func (o *Parser) parseCommands() []Command {
 			break
 		}
 
+		// backslash-newline is passed to the shell without the tab
 		line = strings.TrimSpace(line)
+		line = strings.Replace(line, "\\\n\t", "\\\n", -1)
 
 		// skip comment line
 		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
 
-		commands = append(commands, Command{line, true})
+		commands = append(commands, Command{Exestr: line, NeedEcho: true, Pos: o.pos})
 	}
 
 	return commands
 }
 
 func (o *Parser) preprocess() error {
-	// varmap
-	varmap := map[string]string{}
-	for k, v := range o.varmap {
-		varmap[k] = o.resolveVariable(v)
-	}
-	o.varmap = varmap
+	// variables are expanded by MakeRule.Expand when they are referred
 
 	// targets
-	targets := map[string]int{}
+	entries := append([]entry{}, o.entries...)
 	for name, id := range o.targets {
-		name = o.resolveVariable(name)
-		names := strings.Fields(name)
+		entries = append(entries, entry{name, id})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].rule < entries[j].rule
+	})
 
-		for _, n := range names {
-			if _, ok := targets[n]; ok {
-				return errors.New("Error: Duplicate rule define " + n)
+	targets := map[string]int{}
+	order := []string{}
+	patterns := []Pattern{}
+	merged := map[int]bool{}
+	for _, en := range entries {
+		o.pos = o.rules[en.rule].Pos
+		for _, n := range o.resolveNames(en.targets) {
+			if strings.Contains(n, "%") {
+				patterns = append(patterns, Pattern{n, en.rule})
+				continue
+			}
+
+			id, ok := targets[n]
+			if !ok {
+				targets[n] = en.rule
+				order = append(order, n)
+				continue
+			}
+			if id != en.rule {
+				targets[n] = o.mergeRule(n, id, en.rule, merged)
 			}
-			targets[n] = id
 		}
 	}
 	o.targets = targets
+	o.order = order
+
+	// patterns
+	for _, pattern := range o.patterns {
+		for _, n := range o.resolveNames(pattern.Target) {
+			patterns = append(patterns, Pattern{n, pattern.Rule})
+		}
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return patterns[i].Rule < patterns[j].Rule
+	})
+	o.patterns = patterns
+
+	// phony targets
+	phony := []string{}
+	for _, names := range o.phony {
+		phony = append(phony, o.resolveNames(names)...)
+	}
+	o.phony = phony
+
+	// target-specific varmap
+	targetvars := map[string]map[string]string{}
+	for name, vars := range o.targetvars {
+		names := o.resolveNames(name)
+
+		for _, n := range names {
+			if _, ok := targetvars[n]; !ok {
+				targetvars[n] = map[string]string{}
+			}
+			for k, v := range vars {
+				targetvars[n][k] = v
+			}
+		}
+	}
+	o.targetvars = targetvars
 
 	// rules
 	rules := []Rule{}
 	for _, rule := range o.rules {
+		o.pos = rule.Pos
+
 		// depends
 		depends := []string{}
 		for _, depend := range rule.Depends {
-			depend := o.resolveVariable(depend)
-			ds := strings.Fields(depend)
-
-			depends = append(depends, ds...)
+			depends = append(depends, o.resolveNames(depend)...)
 		}
 
-		// commands
+		// commands are expanded by MakeRule.ExpandCommands when they run
 		commands := []Command{}
 		for _, cmd := range rule.Commands {
-			exestr := o.resolveVariable(cmd.Exestr)
-
-			// echo flag
-			if strings.HasPrefix(exestr, "@") {
-				commands = append(commands, Command{exestr[1:], false})
-			} else {
-				commands = append(commands, Command{exestr, true})
-			}
+			commands = append(commands, parseCommandPrefix(cmd.Exestr, cmd))
 		}
 
-		rules = append(rules, Rule{depends, commands})
+		rules = append(rules, Rule{depends, commands, rule.Pos})
 	}
 	o.rules = rules
 
-	return nil
+	return o.err
 }
 
-func (o *Parser) inputHasNext() bool {
-	return len(o.buffer) > 0 || o.scanner.Scan()
+// mergeRule merges the rule of id into the rule old of target,
+// and returns the id of the merged rule. The prerequisites of the rule
+// with commands come first. When both have commands, the later ones
+// override the others with warnings.
+func (o *Parser) mergeRule(target string, old, id int, merged map[int]bool) int {
+	a, b := o.rules[old], o.rules[id]
+
+	rule := Rule{Pos: a.Pos}
+	if len(b.Commands) > 0 {
+		if len(a.Commands) > 0 {
+			o.warnings = append(o.warnings,
+				newWarning(b.Pos, "Overriding recipe for target "+target),
+				newWarning(a.Pos, "Ignoring old recipe for target "+target))
+		}
+		a, b = b, a
+		rule.Pos = a.Pos
+	}
+	rule.Depends = append(append([]string{}, a.Depends...), b.Depends...)
+	rule.Commands = a.Commands
+
+	// a rule merged already is only for target
+	if merged[old] {
+		o.rules[old] = rule
+		return old
+	}
+
+	o.rules = append(o.rules, rule)
+	merged[len(o.rules)-1] = true
+	return len(o.rules) - 1
 }
 
-func (o *Parser) inputText() string {
-	if len(o.buffer) > 0 {
-		str := o.buffer[len(o.buffer)-1]
-		o.buffer = o.buffer[:len(o.buffer)-1]
-		return str
-	} else {
-		return o.scanner.Text()
+// parseCommandPrefix returns cmd with exestr whose prefix is taken as flags.
+// The prefix is any combination of '@', '-' and '+'.
+func parseCommandPrefix(exestr string, cmd Command) Command {
+	for len(exestr) > 0 && strings.ContainsRune("@-+", rune(exestr[0])) {
+		switch exestr[0] {
+		case '@':
+			// echo flag
+			cmd.NeedEcho = false
+		case '-':
+			// ignore error flag
+			cmd.IgnoreError = true
+		case '+':
+			// force execute flag
+			cmd.Force = true
+		}
+		exestr = strings.TrimLeft(exestr[1:], " \t")
 	}
+
+	cmd.Exestr = exestr
+	return cmd
 }
 
-func (o *Parser) inputUnget(str string) {
-	o.buffer = append(o.buffer, str)
+var continuation_class = regexp.MustCompile(`[ \t]*\\\n[ \t]*`)
+
+// isContinued reports whether line ends with a backslash not escaped.
+func isContinued(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, "\\"))
+	return n%2 == 1
 }
 
-func (o *Parser) resolveVariable(str string) string {
-	regstr_name := `\$(?:{\w+}|\(\w+\))`
-	pickup_name := regexp.MustCompile(regstr_name)
+// joinContinuation joins the continued lines of line with a single space.
+func joinContinuation(line string) string {
+	if !strings.Contains(line, "\n") {
+		return line
+	}
+	return continuation_class.ReplaceAllString(line, " ")
+}
 
-	expand_pos := pickup_name.FindAllStringIndex(str, -1)
-	if len(expand_pos) == 0 {
-		return str
-	} else {
-		res := ""
-		lastindex := 0
+// inputHasNext reports whether a line is available. Conditional
+// directives are evaluated here, and lines in the branches not taken
+// are skipped. An error stops the input and is kept in o.err.
+func (o *Parser) inputHasNext() bool {
+	if o.err != nil {
+		return false
+	}
+	if len(o.buffer) > 0 {
+		return true
+	}
 
-		for _, pos := range expand_pos {
-			res += str[lastindex:pos[0]]
-			name := str[pos[0]+2 : pos[1]-1]
+	for len(o.inputs) > o.floor {
+		// continue to the including input at the end of input
+		in := o.inputs[len(o.inputs)-1]
+		if !in.scanner.Scan() {
+			o.inputs = o.inputs[:len(o.inputs)-1]
+			continue
+		}
+		in.advance()
+
+		line := in.scanner.Text()
+		pos := in.pos
+		pos.Column = 1 + len(line) - len(strings.TrimLeft(line, " \t"))
+		if o.raw {
+			o.buffer = append(o.buffer, sourceLine{line, pos})
+			return true
+		}
 
-			if _, ok := o.varmap[name]; !ok {
-				// deal with empty string
-			} else {
-				val, _ := o.varmap[name]
-				res += o.resolveVariable(val)
-			}
-			lastindex = pos[1]
+		// a line ending with backslash continues to the next line
+		for isContinued(line) && in.scanner.Scan() {
+			in.advance()
+			line += "\n" + in.scanner.Text()
 		}
 
-		if lastindex != len(str) {
-			res += str[lastindex:len(str)]
+		ok, err := o.parseConditional(joinContinuation(line), pos)
+		if err != nil {
+			o.err = err
+			return false
+		}
+		if ok || !o.conditionActive() {
+			continue
 		}
 
-		return res
+		o.buffer = append(o.buffer, sourceLine{line, pos})
+		return true
+	}
+
+	if len(o.conds) > 0 {
+		o.err = newError(o.conds[len(o.conds)-1].pos, ConditionalError, "Missing endif")
+	}
+	return false
+}
+
+// inputText takes the next line.
+func (o *Parser) inputText() string {
+	line := o.buffer[len(o.buffer)-1]
+	o.buffer = o.buffer[:len(o.buffer)-1]
+	o.pos = line.pos
+	return line.text
+}
+
+// inputUnget returns str taken last to be taken again.
+func (o *Parser) inputUnget(str string) {
+	o.buffer = append(o.buffer, sourceLine{str, o.pos})
+}
+
+// advance moves the position to the next line.
+func (in *input) advance() {
+	if !in.fixed {
+		in.pos.Line++
+	}
+}
+
+// inputPush makes r the input read next, included from the input
+// whose chain of including files is chain.
+func (o *Parser) inputPush(r io.Reader, name string, chain []string) {
+	if name != "" {
+		chain = append(append([]string{}, chain...), absPath(name))
+	}
+	o.inputs = append(o.inputs, &input{
+		scanner: bufio.NewScanner(r),
+		name:    name,
+		chain:   chain,
+		pos:     Position{File: name},
+	})
+}
+
+// resolveVariable expands str with the global variables for a simply
+// expanded variable. References which depend on a target are left for
+// MakeRule.Expand, and then simple is false and the result is escaped
+// to be expanded again.
+func (o *Parser) resolveVariable(str string) (val string, simple bool) {
+	lookup := func(name string) (string, bool) {
+		val, ok := o.varmap[name]
+		return val, ok
+	}
+	e := newExpander(lookup, o.isTargetDependent)
+	e.simple = o.isSimple
+	e.fsys = o.fsys
+	e.shell = o.shellOutput
+	e.eval = o.evalText
+	if val = e.expand(str); e.kept {
+		return val, false
+	}
+	return e.unescape(val), true
+}
+
+// resolveNames expands str completely and splits it into names.
+func (o *Parser) resolveNames(str string) []string {
+	return strings.Fields(o.resolveString(str))
+}
+
+// resolveString expands str completely with the global variables.
+func (o *Parser) resolveString(str string) string {
+	lookup := func(name string) (string, bool) {
+		val, ok := o.varmap[name]
+		return val, ok
+	}
+
+	e := newExpander(lookup, nil)
+	e.simple = o.isSimple
+	e.fsys = o.fsys
+	e.shell = o.shellOutput
+	e.eval = o.evalText
+	return e.expand(str)
+}
+
+// isSimple reports whether name is a simply expanded variable.
+func (o *Parser) isSimple(name string) bool {
+	return o.simple[name]
+}
+
+// isTargetDependent reports whether name is an automatic variable,
+// whose value depends on a target. The parameters of call are also
+// left for the expansion in call. A variable with target-specific
+// values is expanded with its global value.
+func (o *Parser) isTargetDependent(name string) bool {
+	if isAutomatic(name) {
+		return true
 	}
+	_, err := strconv.Atoi(name)
+	return err == nil
 }
@@ -1,36 +1,52 @@
 package parser
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 )
 
 func make_parser(r io.Reader) *Parser {
-	return &Parser{
-		scanner: bufio.NewScanner(r),
-		buffer:  []string{},
-		varmap:  map[string]string{},
-		targets: map[string]int{},
-		rules:   []Rule{},
-	}
+	return newParser(r)
 }
 
 func make_rule(depends []string, commands []string) Rule {
 	cmds := []Command{}
 	for _, cmd := range commands {
-		cmds = append(cmds, Command{cmd, true})
+		cmds = append(cmds, Command{Exestr: cmd, NeedEcho: true})
 	}
 
-	return Rule{depends, cmds}
+	return Rule{Depends: depends, Commands: cmds}
 }
 
 func make_rule2(depends []string, commands []Command) Rule {
-	return Rule{depends, commands}
+	return Rule{Depends: depends, Commands: commands}
+}
+
+// at_lines returns rule at line with the commands at command_lines,
+// which are indented by a tab.
+func at_lines(rule Rule, line int, command_lines ...int) Rule {
+	rule.Pos = Position{Line: line, Column: 1}
+	for i, n := range command_lines {
+		rule.Commands[i].Pos = Position{Line: n, Column: 2}
+	}
+	return rule
+}
+
+// clear_command_positions returns commands without the source positions.
+func clear_command_positions(commands []Command) []Command {
+	res := []Command{}
+	for _, cmd := range commands {
+		cmd.Pos = Position{}
+		res = append(res, cmd)
+	}
+	return res
 }
 
 func TestRun_readAndParse(t *testing.T) {
@@ -60,11 +76,11 @@ func TestRun_readAndParse(t *testing.T) {
 		}
 
 		if !reflect.DeepEqual(parser.targets, targets) {
-			return errors.New(fmt.Sprintf("expected %q to eq %q", parser.targets, targets))
+			return errors.New(fmt.Sprintf("expected %v to eq %v", parser.targets, targets))
 		}
 
 		if !reflect.DeepEqual(parser.rules, rules) {
-			return errors.New(fmt.Sprintf("expected %q to eq %q", parser.rules, rules))
+			return errors.New(fmt.Sprintf("expected %v to eq %v", parser.rules, rules))
 		}
 
 		return nil
@@ -84,11 +100,11 @@ func TestRun_readAndParse(t *testing.T) {
 		}
 
 		if !reflect.DeepEqual(parser.targets, targets) {
-			return errors.New(fmt.Sprintf("expected %q to eq %q", parser.targets, targets))
+			return errors.New(fmt.Sprintf("expected %v to eq %v", parser.targets, targets))
 		}
 
 		if !reflect.DeepEqual(parser.rules, rules) {
-			return errors.New(fmt.Sprintf("expected %q to eq %q", parser.rules, rules))
+			return errors.New(fmt.Sprintf("expected %v to eq %v", parser.rules, rules))
 		}
 
 		return nil
@@ -196,10 +212,10 @@ VAR1 = var2
 rule1 : 
 `
 	rules := []Rule{
-		make_rule(
+		at_lines(make_rule(
 			[]string{""},
 			[]string{},
-		),
+		), 2),
 	}
 	targets := map[string]int{
 		"rule1": 0,
@@ -218,18 +234,18 @@ rule3 :
 	# comment rule3
 `
 	rules = []Rule{
-		make_rule(
+		at_lines(make_rule(
 			[]string{"rule2  rule3"},
 			[]string{},
-		),
-		make_rule(
+		), 2),
+		at_lines(make_rule(
 			[]string{"rule3"},
 			[]string{},
-		),
-		make_rule(
+		), 4),
+		at_lines(make_rule(
 			[]string{""},
 			[]string{},
-		),
+		), 6),
 	}
 	targets = map[string]int{
 		"rule1": 0,
@@ -249,19 +265,19 @@ rule2 :
 	echo rule2
 `
 	rules = []Rule{
-		make_rule(
+		at_lines(make_rule(
 			[]string{"rule2"},
 			[]string{
 				"echo rule1",
 				"echo end",
 			},
-		),
-		make_rule(
+		), 2, 3, 4),
+		at_lines(make_rule(
 			[]string{""},
 			[]string{
 				"echo rule2",
 			},
-		),
+		), 5, 6),
 	}
 	targets = map[string]int{
 		"rule1": 0,
@@ -279,14 +295,14 @@ $(VAR2) :
 	echo $(VAR2)
 `
 	rules = []Rule{
-		make_rule(
+		at_lines(make_rule(
 			[]string{"$(VAR2)"},
 			[]string{"echo $(VAR1)"},
-		),
-		make_rule(
+		), 2, 3),
+		at_lines(make_rule(
 			[]string{""},
 			[]string{"echo $(VAR2)"},
-		),
+		), 4, 5),
 	}
 	targets = map[string]int{
 		"$(VAR1)": 0,
@@ -303,13 +319,13 @@ rule1 :
 	echo echo2
 `
 	rules = []Rule{
-		make_rule2(
+		at_lines(make_rule2(
 			[]string{""},
 			[]Command{
-				Command{"@echo echo1", true},
-				Command{"echo echo2", true},
+				Command{Exestr: "@echo echo1", NeedEcho: true},
+				Command{Exestr: "echo echo2", NeedEcho: true},
 			},
-		),
+		), 2, 3, 4),
 	}
 	targets = map[string]int{
 		"rule1": 0,
@@ -337,18 +353,18 @@ $(VAR3) :
 		"VAR3": "rule3",
 	}
 	rules = []Rule{
-		make_rule(
+		at_lines(make_rule(
 			[]string{"$(VAR2)"},
 			[]string{"echo rule1"},
-		),
-		make_rule(
+		), 6, 7),
+		at_lines(make_rule(
 			[]string{"rule3"},
 			[]string{"echo $(VAR2)"},
-		),
-		make_rule(
+		), 8, 9),
+		at_lines(make_rule(
 			[]string{""},
 			[]string{"echo $(VAR3)"},
-		),
+		), 10, 11),
 	}
 	targets = map[string]int{
 		"rule1":   0,
@@ -376,18 +392,18 @@ rule2 :
 		"CMD2": "@$(ECHO) rule2",
 	}
 	rules = []Rule{
-		make_rule2(
+		at_lines(make_rule2(
 			[]string{""},
 			[]Command{
-				Command{"$(CMD1)", true},
+				Command{Exestr: "$(CMD1)", NeedEcho: true},
 			},
-		),
-		make_rule2(
+		), 6, 7),
+		at_lines(make_rule2(
 			[]string{""},
 			[]Command{
-				Command{"$(CMD2)", true},
+				Command{Exestr: "$(CMD2)", NeedEcho: true},
 			},
-		),
+		), 8, 9),
 	}
 	targets = map[string]int{
 		"rule1": 0,
@@ -410,11 +426,11 @@ func TestRun_preprocess(t *testing.T) {
 		}
 
 		if !reflect.DeepEqual(parser.targets, targets) {
-			return errors.New(fmt.Sprintf("expected %q to eq %q", parser.targets, targets))
+			return errors.New(fmt.Sprintf("expected %v to eq %v", parser.targets, targets))
 		}
 
 		if !reflect.DeepEqual(parser.rules, rules) {
-			return errors.New(fmt.Sprintf("expected %q to eq %q", parser.rules, rules))
+			return errors.New(fmt.Sprintf("expected %v to eq %v", parser.rules, rules))
 		}
 
 		return nil
@@ -447,9 +463,10 @@ func TestRun_preprocess(t *testing.T) {
 		"$(VAR3)": 2,
 	}
 
+	// recursive variables are kept unexpanded
 	expected_varmap := map[string]string{
 		"VAR":  "rule",
-		"VAR2": "rule2",
+		"VAR2": "$(VAR)2",
 		"VAR3": "rule3",
 	}
 	expected_rules := []Rule{
@@ -459,11 +476,11 @@ func TestRun_preprocess(t *testing.T) {
 		),
 		make_rule(
 			[]string{"rule3"},
-			[]string{"echo rule2"},
+			[]string{"echo $(VAR2)"},
 		),
 		make_rule(
 			[]string{},
-			[]string{"echo rule3"},
+			[]string{"echo $(VAR3)"},
 		),
 	}
 	expected_targets := map[string]int{
@@ -486,13 +503,13 @@ func TestRun_preprocess(t *testing.T) {
 		make_rule2(
 			[]string{""},
 			[]Command{
-				Command{"$(CMD1)", true},
+				Command{Exestr: "$(CMD1)", NeedEcho: true},
 			},
 		),
 		make_rule2(
 			[]string{""},
 			[]Command{
-				Command{"$(CMD2)", true},
+				Command{Exestr: "$(CMD2)", NeedEcho: true},
 			},
 		),
 	}
@@ -503,20 +520,20 @@ func TestRun_preprocess(t *testing.T) {
 
 	expected_varmap = map[string]string{
 		"ECHO": "echo",
-		"CMD1": "echo rule1",
-		"CMD2": "@echo rule2",
+		"CMD1": "$(ECHO) rule1",
+		"CMD2": "@$(ECHO) rule2",
 	}
 	expected_rules = []Rule{
 		make_rule2(
 			[]string{},
 			[]Command{
-				Command{"echo rule1", true},
+				Command{Exestr: "$(CMD1)", NeedEcho: true},
 			},
 		),
 		make_rule2(
 			[]string{},
 			[]Command{
-				Command{"echo rule2", false},
+				Command{Exestr: "$(CMD2)", NeedEcho: true},
 			},
 		),
 	}
@@ -528,6 +545,22 @@ func TestRun_preprocess(t *testing.T) {
 		t.Error(err)
 	}
 
+	// the prefix is taken after the expansion
+	mr := &MakeRule{Variables: parser.varmap}
+	expected_commands := []Command{
+		Command{Exestr: "echo rule1", NeedEcho: true},
+		Command{Exestr: "echo rule2", NeedEcho: false},
+	}
+	for i, rule := range parser.rules {
+		cmds, err := mr.ExpandCommands("", &Automatic{}, rule.Commands[0])
+		if err != nil {
+			t.Fatalf("error happened: %q", err)
+		}
+		if !reflect.DeepEqual(clear_command_positions(cmds), expected_commands[i:i+1]) {
+			t.Errorf("expected %v to eq %v", cmds, expected_commands[i:i+1])
+		}
+	}
+
 	// multi target rule
 	parser = make_parser(strings.NewReader(""))
 	parser.varmap = map[string]string{}
@@ -572,3 +605,638 @@ func TestRun_preprocess(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestRun_mergeRules(t *testing.T) {
+	tests := []struct {
+		comment  string
+		str      string
+		target   string
+		expected Rule
+	}{
+		{
+			"prerequisites only",
+			"a: b\na: c\n",
+			"a",
+			at_lines(make_rule([]string{"b", "c"}, []string{}), 1),
+		},
+		{
+			"prerequisites of the recipe come first",
+			"a: b\na: c\n\techo a\na: d\n",
+			"a",
+			at_lines(make_rule([]string{"c", "b", "d"}, []string{"echo a"}), 2, 3),
+		},
+		{
+			"multiple targets",
+			"a b: c\n\techo $@\nb: d\n",
+			"b",
+			at_lines(make_rule([]string{"c", "d"}, []string{"echo $@"}), 1, 2),
+		},
+		{
+			"shared rule is kept",
+			"a b: c\n\techo $@\nb: d\n",
+			"a",
+			at_lines(make_rule([]string{"c"}, []string{"echo $@"}), 1, 2),
+		},
+		{
+			"later recipe wins",
+			"a: b\n\techo 1\na: c\n\techo 2\n",
+			"a",
+			at_lines(make_rule([]string{"c", "b"}, []string{"echo 2"}), 3, 4),
+		},
+	}
+
+	for _, tt := range tests {
+		mr, err := Parse(strings.NewReader(tt.str))
+		if err != nil {
+			t.Errorf("%s: error happened: %q", tt.comment, err)
+			continue
+		}
+
+		id, ok := mr.Targets[tt.target]
+		if !ok {
+			t.Errorf("%s: expected %q to be defined", tt.comment, tt.target)
+			continue
+		}
+		rule := mr.Rules[id]
+		if !reflect.DeepEqual(rule, tt.expected) {
+			t.Errorf("%s: expected %v to eq %v", tt.comment, rule, tt.expected)
+		}
+	}
+}
+
+func TestRun_targetVariables(t *testing.T) {
+	str := `
+SHELL = /bin/sh
+FLAGS = -c
+rule1 : SHELL = /bin/bash
+rule2 rule3 : .SHELLFLAGS := -e $(FLAGS)
+rule1 :
+	echo rule1
+rule2 :
+	echo rule2
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected_targetvars := map[string]map[string]string{
+		"rule1": {"SHELL": "/bin/bash"},
+		"rule2": {".SHELLFLAGS": "-e -c"},
+		"rule3": {".SHELLFLAGS": "-e -c"},
+	}
+	if !reflect.DeepEqual(mr.TargetVariables, expected_targetvars) {
+		t.Errorf("expected %v to eq %v", mr.TargetVariables, expected_targetvars)
+	}
+
+	// target-specific value first
+	tests := []struct {
+		target, name, value string
+		ok                  bool
+	}{
+		{"rule1", "SHELL", "/bin/bash", true},
+		{"rule2", "SHELL", "/bin/sh", true},
+		{"rule2", ".SHELLFLAGS", "-e -c", true},
+		{"rule1", ".SHELLFLAGS", "", false},
+	}
+	for _, tt := range tests {
+		value, ok := mr.Variable(tt.target, tt.name)
+		if value != tt.value || ok != tt.ok {
+			t.Errorf("expected (%q, %v) to eq (%q, %v)", value, ok, tt.value, tt.ok)
+		}
+	}
+}
+
+func TestRun_simpleTargetVariables(t *testing.T) {
+	str := `
+foo : CFLAGS = -debug
+CFLAGS = -O2
+X := $(CFLAGS)
+CFLAGS = -g
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	// the global value is taken when := is read
+	for _, target := range []string{"foo", "all"} {
+		if result, err := mr.Expand(target, nil, "$(X)"); err != nil || result != "-O2" {
+			t.Errorf("%s: expected %q to eq %q", target, result, "-O2")
+		}
+	}
+}
+
+func TestRun_parseCommandPrefix(t *testing.T) {
+	tests := []struct {
+		exestr   string
+		expected Command
+	}{
+		{"echo", Command{Exestr: "echo", NeedEcho: true}},
+		{"@echo", Command{Exestr: "echo", NeedEcho: false}},
+		{"-echo", Command{Exestr: "echo", NeedEcho: true, IgnoreError: true}},
+		{"+echo", Command{Exestr: "echo", NeedEcho: true, Force: true}},
+		{"@-+echo", Command{Exestr: "echo", NeedEcho: false, IgnoreError: true, Force: true}},
+		{"+ - @ echo -n", Command{Exestr: "echo -n", NeedEcho: false, IgnoreError: true, Force: true}},
+		{"echo -@+", Command{Exestr: "echo -@+", NeedEcho: true}},
+	}
+
+	for _, tt := range tests {
+		result := parseCommandPrefix(tt.exestr, Command{Exestr: tt.exestr, NeedEcho: true})
+		if result != tt.expected {
+			t.Errorf("expected %v to eq %v", result, tt.expected)
+		}
+	}
+}
+
+func TestRun_phony(t *testing.T) {
+	str := `
+TARGETS = all install
+.PHONY : clean
+	echo ignored
+.PHONY : $(TARGETS)
+all :
+	echo all
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected_phony := map[string]bool{
+		"clean":   true,
+		"all":     true,
+		"install": true,
+	}
+	if !reflect.DeepEqual(mr.Phony, expected_phony) {
+		t.Errorf("expected %v to eq %v", mr.Phony, expected_phony)
+	}
+
+	expected_targets := map[string]int{
+		"all": 0,
+	}
+	if !reflect.DeepEqual(mr.Targets, expected_targets) {
+		t.Errorf("expected %v to eq %v", mr.Targets, expected_targets)
+	}
+
+	// the commands of .PHONY are not of any rule
+	if len(mr.Rules) != 1 || len(mr.Rules[0].Commands) != 1 {
+		t.Errorf("expected %v to have one rule with one command", mr.Rules)
+	}
+}
+
+func TestRun_DefaultGoal(t *testing.T) {
+	tester := func(str string, order []string, goal string) error {
+		mr, err := Parse(strings.NewReader(str))
+		if err != nil {
+			return errors.New(fmt.Sprintf("error happened: %q", err))
+		}
+
+		if !reflect.DeepEqual(mr.Order, order) {
+			return errors.New(fmt.Sprintf("expected %q to eq %q", mr.Order, order))
+		}
+
+		result, _ := mr.DefaultGoal()
+		if result != goal {
+			return errors.New(fmt.Sprintf("expected %q to eq %q", result, goal))
+		}
+
+		return nil
+	}
+
+	// first target
+	str := `
+rule3 rule1 :
+rule2 :
+`
+	if err := tester(str, []string{"rule3", "rule1", "rule2"}, "rule3"); err != nil {
+		t.Error(err)
+	}
+
+	// special and pattern targets are skipped
+	str = `
+.SUFFIXES :
+%.o : %.c
+.PHONY : rule2
+rule2 :
+`
+	if err := tester(str, []string{".SUFFIXES", "rule2"}, "rule2"); err != nil {
+		t.Error(err)
+	}
+
+	// declared goal
+	str = `
+rule1 :
+rule2 :
+.DEFAULT_GOAL := rule2
+`
+	if err := tester(str, []string{"rule1", "rule2"}, "rule2"); err != nil {
+		t.Error(err)
+	}
+
+	// no target
+	str = `
+VAR = var
+`
+	if err := tester(str, []string{}, ""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRun_include(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.mk":    "include a.mk\n-include missing.mk\ninclude = not directive\nmain : a b\n",
+		"a.mk":       "A = a\na :\ninclude sub/*.mk\n",
+		"sub/b.mk":   "b :\n",
+		"sibling.mk": "include inc/c.mk inc/d.mk\n",
+		"inc/c.mk":   "c :\ninclude d.mk\n",
+		"inc/d.mk":   "D += d\n",
+		"cycle.mk":   "include cycle2.mk\n",
+		"cycle2.mk":  "include cycle.mk\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "main.mk")
+	fd, _ := os.Open(path)
+	defer fd.Close()
+
+	mr, err := Parse(fd, FileName(path))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected_order := []string{"a", "b", "main"}
+	if !reflect.DeepEqual(mr.Order, expected_order) {
+		t.Errorf("expected %q to eq %q", mr.Order, expected_order)
+	}
+	if mr.Variables["A"] != "a" || mr.Variables["include"] != "not directive" {
+		t.Errorf("unexpected variables %v", mr.Variables)
+	}
+
+	// a file included again by its sibling is not a cycle
+	path = filepath.Join(dir, "sibling.mk")
+	fd3, _ := os.Open(path)
+	defer fd3.Close()
+
+	mr, err = Parse(fd3, FileName(path))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if mr.Variables["D"] != "d d" {
+		t.Errorf("expected %q to eq %q", mr.Variables["D"], "d d")
+	}
+
+	// include cycle
+	path = filepath.Join(dir, "cycle.mk")
+	fd2, _ := os.Open(path)
+	defer fd2.Close()
+
+	if _, err := Parse(fd2, FileName(path)); err == nil {
+		t.Errorf("expected include cycle error")
+	}
+}
+
+func TestRun_assignOperators(t *testing.T) {
+	tests := []struct {
+		comment  string
+		str      string
+		expected map[string]string
+	}{
+		{
+			"append to recursive variable",
+			`
+A = a
+R = $(A)
+R += $(A)
+A = b
+`,
+			map[string]string{"A": "b", "R": "$(A) $(A)"},
+		},
+		{
+			"append to simple variable",
+			`
+A = a
+S := $(A)
+S += $(A)
+A = b
+`,
+			map[string]string{"A": "b", "S": "a a"},
+		},
+		{
+			"append to undefined and empty variable",
+			`
+E =
+E += e
+U += u
+`,
+			map[string]string{"E": "e", "U": "u"},
+		},
+		{
+			"conditional assign",
+			`
+D = defined
+D ?= other
+U ?= undefined
+`,
+			map[string]string{"D": "defined", "U": "undefined"},
+		},
+		{
+			"override",
+			`
+override O = first
+O = ignored
+O += ignored
+override O += second
+`,
+			map[string]string{"O": "first second"},
+		},
+	}
+
+	for _, tt := range tests {
+		parser := make_parser(strings.NewReader(tt.str))
+		if err := parser.readAndParse(); err != nil {
+			t.Errorf("%s: error happened: %q", tt.comment, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parser.varmap, tt.expected) {
+			t.Errorf("%s: expected %q to eq %q", tt.comment, parser.varmap, tt.expected)
+		}
+	}
+}
+
+func TestRun_shellAssign(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell only")
+	}
+
+	str := `
+WORD = hello
+OUT != echo $(WORD); echo world
+`
+	parser := make_parser(strings.NewReader(str))
+	if err := parser.readAndParse(); err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	if parser.varmap["OUT"] != "hello world" {
+		t.Errorf("expected %q to eq %q", parser.varmap["OUT"], "hello world")
+	}
+	if parser.varmap[".SHELLSTATUS"] != "0" {
+		t.Errorf("expected %q to eq %q", parser.varmap[".SHELLSTATUS"], "0")
+	}
+}
+
+func TestRun_targetAssignOperators(t *testing.T) {
+	str := `
+FLAGS = -O2
+rule1 : FLAGS += -g
+rule1 : OTHER ?= other
+rule2 : FLAGS ?= ignored
+rule1 rule2 :
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected := map[string]map[string]string{
+		"rule1": {"FLAGS": "-O2 -g", "OTHER": "other"},
+		"rule2": {},
+	}
+	if !reflect.DeepEqual(mr.TargetVariables, expected) {
+		t.Errorf("expected %v to eq %v", mr.TargetVariables, expected)
+	}
+}
+
+func TestRun_commandLineVariables(t *testing.T) {
+	str := `
+A = file
+B = file
+B += appended
+override C = override
+rule1 : A = target
+D := $(A)
+rule1 :
+`
+	mr, err := Parse(strings.NewReader(str), CommandLineVariables("A=cmd", "B:=$(A) b", "C=cmd"))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected := map[string]string{"A": "cmd", "B": "cmd b", "C": "override", "D": "cmd"}
+	for name, value := range expected {
+		if mr.Variables[name] != value {
+			t.Errorf("expected %q to eq %q", mr.Variables[name], value)
+		}
+	}
+
+	if val, _ := mr.Variable("rule1", "A"); val != "cmd" {
+		t.Errorf("expected %q to eq %q", val, "cmd")
+	}
+}
+
+func TestRun_environment(t *testing.T) {
+	str := `
+FILE = makefile
+OVERRIDE = makefile
+DEFAULT ?= makefile
+SHELL_VALUE := $(SHELL)
+`
+	environ := []string{"FILE=env", "OVERRIDE=env", "DEFAULT=env", "HOME=/home/user", "SHELL=/bin/false"}
+
+	tests := []struct {
+		override bool
+		expected map[string]string
+	}{
+		{false, map[string]string{"FILE": "makefile", "OVERRIDE": "makefile", "DEFAULT": "env", "HOME": "/home/user", "SHELL_VALUE": ""}},
+		{true, map[string]string{"FILE": "env", "OVERRIDE": "env", "DEFAULT": "env", "HOME": "/home/user", "SHELL_VALUE": ""}},
+	}
+
+	for _, tt := range tests {
+		mr, err := Parse(strings.NewReader(str), Environment(environ, tt.override))
+		if err != nil {
+			t.Fatalf("error happened: %q", err)
+		}
+
+		for name, value := range tt.expected {
+			if mr.Variables[name] != value {
+				t.Errorf("expected %q to eq %q", mr.Variables[name], value)
+			}
+		}
+	}
+}
+
+func TestRun_Environ(t *testing.T) {
+	tests := []struct {
+		comment  string
+		str      string
+		expected []string
+	}{
+		{
+			"environment and command line variables are exported",
+			`
+HOME = /home/other
+LOCAL = local
+`,
+			[]string{"KEEP=keep", "CMD=cmd", "HOME=/home/other"},
+		},
+		{
+			"export and unexport directives",
+			`
+export LOCAL = local
+A = a
+B = b
+export A B
+unexport HOME CMD
+`,
+			[]string{"KEEP=keep", "A=a", "B=b", "LOCAL=local"},
+		},
+		{
+			"export target-specific value",
+			`
+export LOCAL = local
+rule1 : LOCAL = $@
+rule1 :
+`,
+			[]string{"KEEP=keep", "CMD=cmd", "HOME=/home/user", "LOCAL=rule1"},
+		},
+		{
+			"export all variables",
+			`
+.EXPORT_ALL_VARIABLES:
+LOCAL = $(CMD)
+.HIDDEN = hidden
+unexport KEEP
+`,
+			[]string{"CMD=cmd", "HOME=/home/user", "LOCAL=cmd"},
+		},
+		{
+			"export all by directive",
+			`
+export
+LOCAL = local
+unexport
+`,
+			[]string{"KEEP=keep", "CMD=cmd", "HOME=/home/user"},
+		},
+	}
+
+	environ := []string{"HOME=/home/user", "KEEP=keep"}
+	for _, tt := range tests {
+		mr, err := Parse(strings.NewReader(tt.str),
+			Environment(environ[:1], false), CommandLineVariables("CMD=cmd"))
+		if err != nil {
+			t.Fatalf("%s: error happened: %q", tt.comment, err)
+		}
+
+		auto := &Automatic{Target: "rule1"}
+		result, err := mr.Environ("rule1", auto, environ)
+		if err != nil {
+			t.Fatalf("error happened: %q", err)
+		}
+		if !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("%s: expected %q to eq %q", tt.comment, result, tt.expected)
+		}
+	}
+}
+
+func TestRun_EnvironUnexpanded(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pwned")
+	str := `
+USED = $(FROM_ENV)
+rule1 :
+`
+	mr, err := Parse(strings.NewReader(str),
+		Environment([]string{"FOO=$(shell touch " + file + ")", "FROM_ENV=$$HOME"}, false))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected := []string{"FOO=$(shell touch " + file + ")", "FROM_ENV=$$HOME"}
+	result, err := mr.Environ("rule1", &Automatic{Target: "rule1"}, []string{})
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %q to eq %q", result, expected)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected %q not to be created", file)
+	}
+
+	// a referred value is expanded as the other variables
+	if result, err := mr.Expand("rule1", nil, "$(USED)"); err != nil || result != "$HOME" {
+		t.Errorf("expected %q to eq %q", result, "$HOME")
+	}
+}
+
+func TestRun_lineContinuation(t *testing.T) {
+	str := "" +
+		"SRCS = a.c \\\n" +
+		"       b.c\\\n" +
+		"\tc.c\n" +
+		"PATH_VAR = C:\\\\\n" +
+		"# comment \\\n" +
+		"  continued\n" +
+		"ifeq ($(SRCS), \\\n" +
+		"      a.c b.c c.c)\n" +
+		"OK = yes\n" +
+		"endif\n" +
+		"all : $(SRCS) \\\n" +
+		"      d.c\n" +
+		"\techo a \\\n" +
+		"\t  b \\\n" +
+		"c\n" +
+		"\t@echo $(OK) \\\\\n" +
+		"\n" +
+		"other :\n"
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	expected := map[string]string{"SRCS": "a.c b.c c.c", "PATH_VAR": "C:\\\\", "OK": "yes"}
+	for name, value := range expected {
+		if mr.Variables[name] != value {
+			t.Errorf("expected %q to eq %q", mr.Variables[name], value)
+		}
+	}
+
+	rule := mr.Rules[mr.Targets["all"]]
+	if rule.Pos != (Position{Line: 11, Column: 1}) {
+		t.Errorf("expected %v to eq %v", rule.Pos, Position{Line: 11, Column: 1})
+	}
+	depends := []string{"a.c", "b.c", "c.c", "d.c"}
+	if !reflect.DeepEqual(rule.Depends, depends) {
+		t.Errorf("expected %q to eq %q", rule.Depends, depends)
+	}
+
+	// the lines joined by backslash-newline are counted
+	commands := []Command{
+		Command{Exestr: "echo a \\\n  b \\\nc", NeedEcho: true, Pos: Position{Line: 13, Column: 2}},
+		Command{Exestr: "echo $(OK) \\\\", NeedEcho: false, Pos: Position{Line: 16, Column: 2}},
+	}
+	if !reflect.DeepEqual(rule.Commands, commands) {
+		t.Errorf("expected %v to eq %v", rule.Commands, commands)
+	}
+
+	auto := &Automatic{Target: "all", Depends: rule.Depends}
+	if result, err := mr.ExpandCommands("all", auto, rule.Commands[0]); err != nil || len(result) != 1 {
+		t.Errorf("expected %v to be one command", result)
+	}
+	if result, err := mr.ExpandCommand("all", auto, rule.Commands[1]); err != nil || result.Exestr != "echo yes \\\\" {
+		t.Errorf("expected %q to eq %q", result.Exestr, "echo yes \\\\")
+	}
+
+	if _, ok := mr.Targets["other"]; !ok {
+		t.Errorf("expected %q to be defined", "other")
+	}
+}
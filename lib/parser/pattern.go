@@ -0,0 +1,172 @@
+package parser
+
+import (
+	"sort"
+	"strings"
+)
+
+// Pattern is a target pattern of a pattern rule, like "%.o".
+type Pattern struct {
+	Target string
+	Rule   int
+}
+
+// Match is the rule selected to make a target.
+type Match struct {
+	Rule     int      // index of MakeRule.Rules
+	Targets  []string // all targets made together by a pattern rule
+	Depends  []string
+	Commands []Command
+	Stem     string
+}
+
+// FindRule returns the rule to make target.
+//
+// An explicit rule with commands, or the rule of a phony target,
+// is used as it is. Otherwise the pattern
+// rule with the shortest stem whose dependencies exist or can be made is
+// used, trying them in the order of definition for the same stem length.
+// exists reports whether a file exists.
+func (mr *MakeRule) FindRule(target string, exists func(string) bool) (*Match, bool) {
+	id, explicit := mr.Targets[target]
+	if explicit && (len(mr.Rules[id].Commands) > 0 || mr.Phony[target]) {
+		return mr.explicitMatch(id, target), true
+	}
+	if mr.Phony[target] {
+		return nil, false
+	}
+
+	if m, ok := mr.findPatternRule(target, exists, map[int]bool{}); ok {
+		if explicit {
+			// dependencies of the explicit rule follow the pattern ones
+			m.Depends = append(m.Depends, mr.Rules[id].Depends...)
+		}
+		return m, true
+	}
+
+	if explicit {
+		return mr.explicitMatch(id, target), true
+	}
+	return nil, false
+}
+
+// explicitMatch returns the rule of id for target.
+// The other targets of an explicit rule are made separately.
+func (mr *MakeRule) explicitMatch(id int, target string) *Match {
+	rule := mr.Rules[id]
+	return &Match{id, []string{target}, rule.Depends, rule.Commands, ""}
+}
+
+// findPatternRule searches the pattern rules except the ones in used,
+// which are already in the chain of intermediate targets.
+func (mr *MakeRule) findPatternRule(target string, exists func(string) bool, used map[int]bool) (*Match, bool) {
+	candidates := []*Match{}
+	for _, pattern := range mr.Patterns {
+		if used[pattern.Rule] {
+			continue
+		}
+
+		stem, ok := matchPattern(pattern.Target, target)
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, mr.patternMatch(pattern, target, stem))
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(candidates[i].Stem) < len(candidates[j].Stem)
+	})
+
+	for _, m := range candidates {
+		used[m.Rule] = true
+		ok := true
+		for _, depend := range m.Depends {
+			if !mr.canMake(depend, exists, used) {
+				ok = false
+				break
+			}
+		}
+		delete(used, m.Rule)
+
+		if ok {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
+
+func (mr *MakeRule) canMake(target string, exists func(string) bool, used map[int]bool) bool {
+	if _, ok := mr.Targets[target]; ok || mr.Phony[target] || exists(target) {
+		return true
+	}
+	_, ok := mr.findPatternRule(target, exists, used)
+	return ok
+}
+
+func (mr *MakeRule) patternMatch(pattern Pattern, target, stem string) *Match {
+	rule := mr.Rules[pattern.Rule]
+
+	// a pattern without slash matches the file name part,
+	// and the directory part is added to the dependencies.
+	dir := ""
+	if !strings.Contains(pattern.Target, "/") {
+		if i := strings.LastIndex(target, "/"); i >= 0 {
+			dir = target[:i+1]
+			stem = stem[len(dir):]
+		}
+	}
+
+	targets := []string{}
+	for _, p := range mr.Patterns {
+		if p.Rule == pattern.Rule {
+			targets = append(targets, substPattern(p.Target, dir, stem))
+		}
+	}
+
+	depends := []string{}
+	for _, depend := range rule.Depends {
+		if strings.Contains(depend, "%") {
+			depend = substPattern(depend, dir, stem)
+		}
+		depends = append(depends, depend)
+	}
+
+	return &Match{pattern.Rule, targets, depends, rule.Commands, dir + stem}
+}
+
+// matchPattern returns the stem of name matched to pattern.
+func matchPattern(pattern, name string) (string, bool) {
+	if !strings.Contains(pattern, "/") {
+		dir := ""
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			dir, name = name[:i+1], name[i+1:]
+		}
+		stem, ok := matchPattern("/"+pattern, "/"+name)
+		if !ok {
+			return "", false
+		}
+		return dir + stem, true
+	}
+
+	i := strings.Index(pattern, "%")
+	prefix, suffix := pattern[:i], pattern[i+1:]
+
+	if len(name) <= len(prefix)+len(suffix) {
+		return "", false
+	}
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// substPattern replaces the first '%' of pattern with stem,
+// and adds dir when pattern has no directory part.
+func substPattern(pattern, dir, stem string) string {
+	res := strings.Replace(pattern, "%", stem, 1)
+	if dir != "" && !strings.Contains(pattern, "/") {
+		res = dir + res
+	}
+	return res
+}
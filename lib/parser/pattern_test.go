@@ -0,0 +1,132 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRun_matchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name, stem string
+		ok                  bool
+	}{
+		{"%.o", "foo.o", "foo", true},
+		{"%.o", "foo.c", "", false},
+		{"%.o", ".o", "", false},
+		{"lib%.a", "libfoo.a", "foo", true},
+		{"%.o", "src/foo.o", "src/foo", true},
+		{"lib%.a", "dir/libfoo.a", "dir/foo", true},
+		{"lib%.a", "libdir/foo.a", "", false},
+		{"obj/%.o", "obj/foo.o", "foo", true},
+		{"obj/%.o", "src/foo.o", "", false},
+	}
+
+	for _, tt := range tests {
+		stem, ok := matchPattern(tt.pattern, tt.name)
+		if stem != tt.stem || ok != tt.ok {
+			t.Errorf("expected (%q, %v) to eq (%q, %v)", stem, ok, tt.stem, tt.ok)
+		}
+	}
+}
+
+func TestRun_FindRule(t *testing.T) {
+	str := `
+%.o : %.c
+	cc -c $<
+obj/%.o : src/%.c
+	cc -c -o $@ $<
+%.c : %.y
+	yacc $<
+lib%.a : lib%.o
+	ar $@ $^
+main.o : config.h
+explicit.o : explicit.c
+	cc explicit
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	files := map[string]bool{
+		"main.c":      true,
+		"src/foo.c":   true,
+		"dir/libx.c":  true,
+		"parser.y":    true,
+		"explicit.c":  true,
+		"unknown.txt": true,
+	}
+	exists := func(path string) bool {
+		return files[path]
+	}
+
+	tests := []struct {
+		target   string
+		ok       bool
+		rule     int
+		targets  []string
+		depends  []string
+		stem     string
+		commands []Command
+	}{
+		// pattern with explicit dependencies
+		{"main.o", true, 0, []string{"main.o"}, []string{"main.c", "config.h"}, "main", []Command{Command{Exestr: "cc -c $<", NeedEcho: true}}},
+		// most specific pattern
+		{"obj/foo.o", true, 1, []string{"obj/foo.o"}, []string{"src/foo.c"}, "foo", []Command{Command{Exestr: "cc -c -o $@ $<", NeedEcho: true}}},
+		// chain of intermediate pattern rules
+		{"parser.o", true, 0, []string{"parser.o"}, []string{"parser.c"}, "parser", []Command{Command{Exestr: "cc -c $<", NeedEcho: true}}},
+		{"dir/libx.a", true, 3, []string{"dir/libx.a"}, []string{"dir/libx.o"}, "dir/x", []Command{Command{Exestr: "ar $@ $^", NeedEcho: true}}},
+		// explicit rule
+		{"explicit.o", true, 5, []string{"explicit.o"}, []string{"explicit.c"}, "", []Command{Command{Exestr: "cc explicit", NeedEcho: true}}},
+		// no rule
+		{"unknown.o", false, 0, nil, nil, "", nil},
+		{"unknown.txt", false, 0, nil, nil, "", nil},
+	}
+
+	for _, tt := range tests {
+		m, ok := mr.FindRule(tt.target, exists)
+		if ok != tt.ok {
+			t.Errorf("%s: expected %v to eq %v", tt.target, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		m.Commands = clear_command_positions(m.Commands)
+		expected := &Match{tt.rule, tt.targets, tt.depends, tt.commands, tt.stem}
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("%s: expected %v to eq %v", tt.target, m, expected)
+		}
+	}
+}
+
+func TestRun_FindRuleAutomatic(t *testing.T) {
+	str := `
+foo.o : config.h
+%.o : %.c
+	cc $< -o $@ ($^)
+`
+	mr, err := Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	exists := func(path string) bool {
+		return path == "foo.c" || path == "config.h"
+	}
+	m, ok := mr.FindRule("foo.o", exists)
+	if !ok {
+		t.Fatalf("expected a rule of %q", "foo.o")
+	}
+
+	auto := &Automatic{Target: "foo.o", Depends: m.Depends, Stem: m.Stem}
+	cmd, err := mr.ExpandCommand("foo.o", auto, m.Commands[0])
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+	if cmd.Exestr != "cc foo.c -o foo.o (foo.c config.h)" {
+		t.Errorf("expected %q to eq %q", cmd.Exestr, "cc foo.c -o foo.o (foo.c config.h)")
+	}
+}
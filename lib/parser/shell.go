@@ -0,0 +1,77 @@
+package parser
+
+import (
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/hidez8891/gomk/lib/runner"
+)
+
+func init() {
+	registerFunction("shell", 1, funcShell)
+}
+
+// $(shell command)
+func funcShell(e *expander, args []string) string {
+	out, _ := e.shell(args[0])
+	return out
+}
+
+// Shell returns the shell running the commands of target,
+// configured by SHELL and .SHELLFLAGS.
+func (mr *MakeRule) Shell(target string) runner.Shell {
+	shell := runner.DefaultShell()
+
+	e := mr.newExpander(target, nil)
+	if path := e.expand("$(SHELL)"); path != "" {
+		shell.Path = path
+	}
+	if _, ok := mr.Variable(target, ".SHELLFLAGS"); ok {
+		shell.Flags = e.expand("$(.SHELLFLAGS)")
+	}
+
+	return shell
+}
+
+// shellOutput runs command with the shell of SHELL and .SHELLFLAGS,
+// and sets its exit status to .SHELLSTATUS.
+func (o *Parser) shellOutput(command string) (string, int) {
+	shell := runner.DefaultShell()
+	if path := o.resolveString("$(SHELL)"); path != "" {
+		shell.Path = path
+	}
+	if _, ok := o.varmap[".SHELLFLAGS"]; ok {
+		shell.Flags = o.resolveString("$(.SHELLFLAGS)")
+	}
+
+	out, status := runShell(shell, command, o.stderr)
+	o.setVariable(".SHELLSTATUS", strconv.Itoa(status), true, originFile)
+	return out, status
+}
+
+// runShell runs command with shell, and returns its output and exit status.
+// The standard error is written to stderr.
+// The trailing newline of the output is removed, and the other newlines
+// are replaced with spaces.
+func runShell(shell runner.Shell, command string, stderr io.Writer) (string, int) {
+	cmd := shell.Command(command)
+	cmd.Stderr = stderr
+
+	status := 0
+	out, err := cmd.Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			status = exit.ExitCode()
+		} else {
+			status = 127
+		}
+	}
+
+	str := strings.Replace(string(out), "\r\n", "\n", -1)
+	str = strings.TrimSuffix(str, "\n")
+	return strings.Replace(str, "\n", " ", -1), status
+}
@@ -4,22 +4,32 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"os/exec"
-	"syscall"
+	"sync"
 )
 
 type Runner struct {
 	outStream, errStream io.Writer
+	shell                Shell
+	env                  []string
 }
 
 func New(out, err io.Writer) *Runner {
-	return &Runner{out, err}
+	return NewWithShell(out, err, DefaultShell())
+}
+
+func NewWithShell(out, err io.Writer, shell Shell) *Runner {
+	return &Runner{out, err, shell, nil}
+}
+
+// SetEnv sets the environment of the commands.
+// nil means the environment of the current process.
+func (r *Runner) SetEnv(env []string) {
+	r.env = env
 }
 
 func (r *Runner) Run(command string) error {
-	cmd := exec.Command("cmd")
-	cmd.SysProcAttr = &syscall.SysProcAttr{}
-	cmd.SysProcAttr.CmdLine = "/C " + command
+	cmd := r.shell.Command(command)
+	cmd.Env = r.env
 
 	out_reader, err := cmd.StdoutPipe()
 	if err != nil {
@@ -35,8 +45,18 @@ func (r *Runner) Run(command string) error {
 		return err
 	}
 
-	go r.echoStdout(out_reader)
-	go r.echoStderr(err_reader)
+	// all output must be read before Wait closes the pipes
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		r.echoStdout(out_reader)
+		wg.Done()
+	}()
+	go func() {
+		r.echoStderr(err_reader)
+		wg.Done()
+	}()
+	wg.Wait()
 
 	err = cmd.Wait()
 	return err
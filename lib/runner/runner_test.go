@@ -2,6 +2,8 @@ package runner
 
 import (
 	"bytes"
+	"os"
+	"runtime"
 	"testing"
 )
 
@@ -44,8 +46,40 @@ func TestRun_Run(t *testing.T) {
 
 	// have double quote
 	cmd = `echo "HOGE"`
-	expected_out = "\"HOGE\"\n"
+	expected_out = "HOGE\n"
+	if runtime.GOOS == "windows" {
+		expected_out = "\"HOGE\"\n"
+	}
 	if !tester(cmd, expected_out, "") {
 		t.Skip()
 	}
 }
+
+func TestRun_RunFailure(t *testing.T) {
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	runner := New(outStream, errStream)
+
+	// non-zero exit status
+	if err := runner.Run("exit 1"); err == nil {
+		t.Errorf("expected error to happen")
+	}
+}
+
+func TestRun_SetEnv(t *testing.T) {
+	outStream, errStream := new(bytes.Buffer), new(bytes.Buffer)
+	runner := New(outStream, errStream)
+	runner.SetEnv([]string{"GOMK_RUNNER=env", "SystemRoot=" + os.Getenv("SystemRoot")})
+
+	cmd := "echo $GOMK_RUNNER"
+	if runtime.GOOS == "windows" {
+		cmd = "echo %GOMK_RUNNER%"
+	}
+	if err := runner.Run(cmd); err != nil {
+		t.Fatalf("error happened: %s", err)
+	}
+
+	expected_out := "env\n"
+	if outStream.String() != expected_out {
+		t.Errorf("expected %q to eq %q", outStream.String(), expected_out)
+	}
+}
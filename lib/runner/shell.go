@@ -0,0 +1,25 @@
+package runner
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// Shell is the command interpreter used to execute a command line.
+type Shell struct {
+	Path  string
+	Flags string
+}
+
+// DefaultShell returns the interpreter of the running platform.
+func DefaultShell() Shell {
+	if runtime.GOOS == "windows" {
+		return Shell{"cmd", "/C"}
+	}
+	return Shell{"/bin/sh", "-c"}
+}
+
+// Command returns the exec.Cmd which runs command through the shell.
+func (s Shell) Command(command string) *exec.Cmd {
+	return shellCommand(s.Path, s.Flags, command)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package runner
+
+import (
+	"os/exec"
+	"strings"
+)
+
+func shellCommand(path, flags, command string) *exec.Cmd {
+	args := append(strings.Fields(flags), command)
+	return exec.Command(path, args...)
+}
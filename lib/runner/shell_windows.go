@@ -0,0 +1,14 @@
+package runner
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// cmd.exe parses its own command line, so pass it through without quoting.
+func shellCommand(path, flags, command string) *exec.Cmd {
+	cmd := exec.Command(path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	cmd.SysProcAttr.CmdLine = flags + " " + command
+	return cmd
+}
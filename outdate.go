@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+)
+
+// outdateChecker decides whether a target must be rebuilt.
+// A target is outdated when it does not exist, when one of its
+// dependencies was rebuilt in this run, or when one of its dependencies
+// is newer than it. Phony targets are never looked up in the file system,
+// they are always outdated and newer than their dependents.
+type outdateChecker struct {
+	modTime func(string) (int64, error)
+	phony   map[string]bool
+	mutex   sync.Mutex
+	rebuilt map[string]bool
+}
+
+func newOutdateChecker(modTime func(string) (int64, error), phony map[string]bool) *outdateChecker {
+	return &outdateChecker{
+		modTime: modTime,
+		phony:   phony,
+		rebuilt: map[string]bool{},
+	}
+}
+
+func (c *outdateChecker) isOutdated(target string, depends []string) bool {
+	if c.phony[target] {
+		return true
+	}
+	if _, err := c.modTime(target); err != nil {
+		return true
+	}
+	return len(c.newer(target, depends)) > 0
+}
+
+// newer returns the dependencies which make target outdated.
+// All of them are returned when target does not exist.
+func (c *outdateChecker) newer(target string, depends []string) []string {
+	if c.phony[target] {
+		return depends
+	}
+
+	target_t, err := c.modTime(target)
+	if err != nil {
+		return depends
+	}
+
+	res := []string{}
+	for _, depend := range depends {
+		if c.phony[depend] || c.isRebuilt(depend) {
+			res = append(res, depend)
+			continue
+		}
+
+		depend_t, err := c.modTime(depend)
+		if err != nil || depend_t > target_t {
+			res = append(res, depend)
+		}
+	}
+
+	return res
+}
+
+func (c *outdateChecker) setRebuilt(targets ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, target := range targets {
+		c.rebuilt[target] = true
+	}
+}
+
+func (c *outdateChecker) isRebuilt(target string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.rebuilt[target]
+}
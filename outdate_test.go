@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRun_isOutdated(t *testing.T) {
+	files := map[string]int64{}
+	modTime := func(path string) (int64, error) {
+		if t, ok := files[path]; ok {
+			return t, nil
+		}
+		return 0, errors.New("not found " + path)
+	}
+
+	depends := []string{"dep1", "dep2"}
+
+	tests := []struct {
+		comment  string
+		files    map[string]int64
+		rebuilt  []string
+		expected bool
+		newer    []string
+	}{
+		{"missing target", map[string]int64{"dep1": 1, "dep2": 1}, nil, true, []string{"dep1", "dep2"}},
+		{"up to date", map[string]int64{"target": 2, "dep1": 1, "dep2": 1}, nil, false, []string{}},
+		{"same time", map[string]int64{"target": 2, "dep1": 2, "dep2": 2}, nil, false, []string{}},
+		{"first dependency newer", map[string]int64{"target": 2, "dep1": 3, "dep2": 1}, nil, true, []string{"dep1"}},
+		{"last dependency newer", map[string]int64{"target": 2, "dep1": 1, "dep2": 3}, nil, true, []string{"dep2"}},
+		{"missing dependency", map[string]int64{"target": 2, "dep1": 1}, nil, true, []string{"dep2"}},
+		{"rebuilt dependency", map[string]int64{"target": 2, "dep1": 1, "dep2": 1}, []string{"dep1"}, true, []string{"dep1"}},
+	}
+
+	for _, tt := range tests {
+		files = tt.files
+		checker := newOutdateChecker(modTime, map[string]bool{})
+		checker.setRebuilt(tt.rebuilt...)
+
+		if result := checker.isOutdated("target", depends); result != tt.expected {
+			t.Errorf("%s: expected %v to eq %v", tt.comment, result, tt.expected)
+		}
+		if result := checker.newer("target", depends); !reflect.DeepEqual(result, tt.newer) {
+			t.Errorf("%s: expected %q to eq %q", tt.comment, result, tt.newer)
+		}
+	}
+
+	// phony targets are not looked up
+	files = map[string]int64{"target": 2, "dep1": 1, "dep2": 1}
+	phony := map[string]bool{"target": true, "dep2": true}
+	checker := newOutdateChecker(modTime, phony)
+	if !checker.isOutdated("target", depends) {
+		t.Errorf("expected phony %q to be outdated", "target")
+	}
+	checker = newOutdateChecker(modTime, map[string]bool{"dep2": true})
+	if result := checker.newer("target", depends); !reflect.DeepEqual(result, []string{"dep2"}) {
+		t.Errorf("expected %q to eq %q", result, []string{"dep2"})
+	}
+
+	// no dependency
+	files = map[string]int64{"dep1": 1}
+	checker = newOutdateChecker(modTime, map[string]bool{})
+	if checker.isOutdated("dep1", []string{}) {
+		t.Errorf("expected existing %q to be up to date", "dep1")
+	}
+}
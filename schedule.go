@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+)
+
+import (
+	"github.com/hidez8891/gomk/lib/parser"
+)
+
+// scheduleNode is a target in the dependency graph.
+// Targets made by a pattern rule with the same stem share one node.
+// match is nil when the target is a file without rule.
+// ran and failed are the results of run.
+type scheduleNode struct {
+	index   int
+	target  string
+	match   *parser.Match
+	depends []*scheduleNode
+	ran     bool
+	failed  bool
+}
+
+// schedule is the dependency graph of the goal targets.
+// Nodes are sorted in execution order, dependencies first.
+// A target depended by several goals has one node.
+type schedule struct {
+	nodes []*scheduleNode
+	goals []*scheduleNode
+}
+
+func (cli *CLI) makeExecuteSchedule(rules *parser.MakeRule, targets ...string) *schedule {
+	s := &schedule{[]*scheduleNode{}, []*scheduleNode{}}
+	visited := map[string]*scheduleNode{}
+	matches := map[string]*parser.Match{}
+
+	findRule := func(t string) *parser.Match {
+		if m, ok := matches[t]; ok {
+			return m
+		}
+		m, _ := rules.FindRule(t, fileExists)
+		matches[t] = m
+		return m
+	}
+
+	nodeKey := func(t string) string {
+		if m := findRule(t); m != nil && m.Stem != "" {
+			return fmt.Sprintf("rule:%d:%s", m.Rule, m.Stem)
+		}
+		return "file:" + t
+	}
+
+	inSameRule := func(keys []string, t string) bool {
+		key := nodeKey(t)
+		for _, k := range keys {
+			if nodeKey(k) == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	var impl func(target string, parent []string) *scheduleNode
+	impl = func(target string, parent []string) *scheduleNode {
+		key := nodeKey(target)
+		if node, ok := visited[key]; ok {
+			return node
+		}
+
+		node := &scheduleNode{target: target, match: findRule(target), depends: []*scheduleNode{}}
+
+		if node.match != nil {
+			parent = append(parent, target)
+			for _, depend := range node.match.Depends {
+				if inSameRule(parent, depend) {
+					fmt.Fprintf(cli.errStream, "Circular %s <- %s dependency dropped\n", target, depend)
+					continue
+				}
+
+				node.depends = append(node.depends, impl(depend, parent))
+			}
+		}
+
+		node.index = len(s.nodes)
+		s.nodes = append(s.nodes, node)
+		visited[key] = node
+		return node
+	}
+
+	for _, target := range targets {
+		node := impl(target, []string{})
+		if !s.hasGoal(node) {
+			s.goals = append(s.goals, node)
+		}
+	}
+	return s
+}
+
+func (s *schedule) hasGoal(node *scheduleNode) bool {
+	for _, goal := range s.goals {
+		if goal == node {
+			return true
+		}
+	}
+	return false
+}
+
+// reached returns the nodes which goal depends on, and goal itself.
+func (s *schedule) reached(goal *scheduleNode) []*scheduleNode {
+	visited := make([]bool, len(s.nodes))
+	res := []*scheduleNode{}
+
+	var impl func(node *scheduleNode)
+	impl = func(node *scheduleNode) {
+		if visited[node.index] {
+			return
+		}
+		visited[node.index] = true
+		for _, dep := range node.depends {
+			impl(dep)
+		}
+		res = append(res, node)
+	}
+
+	impl(goal)
+	return res
+}
+
+// run executes build for every node, at most jobs at once (0 is unlimited).
+// A node starts after all of its dependencies are finished.
+//
+// No new node starts after a failure, unless keepGoing is set. Then only
+// the nodes depending on a failed one are skipped. The failures are
+// returned in execution order, regardless of completion order.
+func (s *schedule) run(jobs int, keepGoing bool, build func(*scheduleNode) (bool, error)) (bool, []error) {
+	type result struct {
+		index int
+		ran   bool
+		err   error
+	}
+
+	results := make(chan result)
+	started := make([]bool, len(s.nodes))
+	finished := make([]bool, len(s.nodes))
+	errs := make([]error, len(s.nodes))
+
+	ready := func(node *scheduleNode) bool {
+		for _, dep := range node.depends {
+			if !finished[dep.index] {
+				return false
+			}
+		}
+		return true
+	}
+
+	dependsOnFailure := func(node *scheduleNode) bool {
+		for _, dep := range node.depends {
+			if dep.failed {
+				return true
+			}
+		}
+		return false
+	}
+
+	running := 0
+	stopped := false
+	ran := false
+
+	for {
+		for _, node := range s.nodes {
+			if stopped || (jobs > 0 && running >= jobs) {
+				break
+			}
+			if started[node.index] || !ready(node) {
+				continue
+			}
+
+			started[node.index] = true
+
+			// skip the node, and the nodes after it depending on it
+			if dependsOnFailure(node) {
+				finished[node.index] = true
+				node.failed = true
+				continue
+			}
+
+			running++
+			go func(node *scheduleNode) {
+				r, err := build(node)
+				results <- result{node.index, r, err}
+			}(node)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+		finished[res.index] = true
+
+		if res.err != nil {
+			errs[res.index] = res.err
+			s.nodes[res.index].failed = true
+			stopped = !keepGoing
+		}
+		if res.ran {
+			ran = true
+			s.nodes[res.index].ran = true
+		}
+	}
+
+	failures := []error{}
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return ran, failures
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/hidez8891/gomk/lib/parser"
+)
+
+func make_schedule(t *testing.T, str string, targets ...string) *schedule {
+	rules, err := parser.Parse(strings.NewReader(str))
+	if err != nil {
+		t.Fatalf("error happened: %q", err)
+	}
+
+	cli := &CLI{outStream: new(bytes.Buffer), errStream: new(bytes.Buffer)}
+	return cli.makeExecuteSchedule(rules, targets...)
+}
+
+func TestRun_makeExecuteSchedule(t *testing.T) {
+	str := `
+all: obj1 obj2
+obj1: src1 common
+obj2: src2 common
+common:
+src1 src2:
+`
+	s := make_schedule(t, str, "all")
+
+	order := []string{}
+	for _, node := range s.nodes {
+		order = append(order, node.target)
+	}
+	expected := []string{"src1", "common", "obj1", "src2", "obj2", "all"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %q to eq %q", order, expected)
+	}
+
+	depends := []string{}
+	for _, dep := range s.nodes[4].depends {
+		depends = append(depends, dep.target)
+	}
+	expected = []string{"src2", "common"}
+	if !reflect.DeepEqual(depends, expected) {
+		t.Errorf("expected %q to eq %q", depends, expected)
+	}
+
+	// targets of a pattern rule with the same stem share one node
+	str = `
+all: a.tab.c a.tab.h
+%.tab.c %.tab.h: %.y
+a.y:
+`
+	s = make_schedule(t, str, "all")
+
+	order = []string{}
+	for _, node := range s.nodes {
+		order = append(order, node.target)
+	}
+	expected = []string{"a.y", "a.tab.c", "all"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %q to eq %q", order, expected)
+	}
+
+	// goals share the nodes of their dependencies
+	str = `
+a: c
+b: c
+c:
+`
+	s = make_schedule(t, str, "a", "b", "a")
+
+	order = []string{}
+	for _, node := range s.nodes {
+		order = append(order, node.target)
+	}
+	expected = []string{"c", "a", "b"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %q to eq %q", order, expected)
+	}
+
+	goals := []string{}
+	for _, node := range s.goals {
+		goals = append(goals, node.target)
+	}
+	expected = []string{"a", "b"}
+	if !reflect.DeepEqual(goals, expected) {
+		t.Errorf("expected %q to eq %q", goals, expected)
+	}
+}
+
+func TestRun_scheduleRun(t *testing.T) {
+	str := `
+all: a b c
+a:
+b:
+c:
+`
+	// sequential order
+	s := make_schedule(t, str, "all")
+	order := []string{}
+	ran, errs := s.run(1, false, func(node *scheduleNode) (bool, error) {
+		order = append(order, node.target)
+		return true, nil
+	})
+	if !ran || len(errs) != 0 {
+		t.Errorf("expected (true, []) to eq (%v, %v)", ran, errs)
+	}
+	expected := []string{"a", "b", "c", "all"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %q to eq %q", order, expected)
+	}
+
+	// independent targets run simultaneously
+	var wg sync.WaitGroup
+	wg.Add(3)
+	ran, errs = s.run(0, false, func(node *scheduleNode) (bool, error) {
+		if node.target == "all" {
+			return false, nil
+		}
+
+		wg.Done()
+		barrier := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(barrier)
+		}()
+
+		select {
+		case <-barrier:
+			return false, nil
+		case <-time.After(5 * time.Second):
+			return false, errors.New(node.target + " did not run in parallel")
+		}
+	})
+	if ran || len(errs) != 0 {
+		t.Errorf("expected (false, []) to eq (%v, %v)", ran, errs)
+	}
+
+	// stop on failure, report the first failure in execution order
+	var mutex sync.Mutex
+	order = []string{}
+	failing := func(node *scheduleNode) (bool, error) {
+		mutex.Lock()
+		order = append(order, node.target)
+		mutex.Unlock()
+
+		switch node.target {
+		case "a":
+			time.Sleep(10 * time.Millisecond)
+			return true, errors.New("a failed")
+		case "c":
+			return true, errors.New("c failed")
+		}
+		return true, nil
+	}
+	_, errs = s.run(0, false, failing)
+	if len(errs) == 0 || errs[0].Error() != "a failed" {
+		t.Errorf("expected %v to start with %q", errs, "a failed")
+	}
+	if inArray(order, "all") {
+		t.Errorf("expected %q not to contain %q", order, "all")
+	}
+}
+
+func TestRun_scheduleRunKeepGoing(t *testing.T) {
+	str := `
+all: a b c
+a: a1
+b: b1
+c: b1
+a1:
+b1:
+`
+	s := make_schedule(t, str, "all")
+
+	order := []string{}
+	_, errs := s.run(1, true, func(node *scheduleNode) (bool, error) {
+		order = append(order, node.target)
+		if node.target == "a1" || node.target == "c" {
+			return true, errors.New(node.target + " failed")
+		}
+		return true, nil
+	})
+
+	// targets not depending on failures are made
+	expected := []string{"a1", "b1", "b", "c"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %q to eq %q", order, expected)
+	}
+
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	expected = []string{"a1 failed", "c failed"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected %q to eq %q", messages, expected)
+	}
+}
+
+func TestRun_jobsArgs(t *testing.T) {
+	tests := []struct {
+		args, expected string
+	}{
+		{"-j", "-j=0"},
+		{"-j 4 all", "-j=4 all"},
+		{"-j4 all", "-j=4 all"},
+		{"-j all", "-j=0 all"},
+		{"-f file -j", "-f file -j=0"},
+		{"-- -j", "-- -j"},
+	}
+
+	for _, tt := range tests {
+		result := strings.Join(jobsArgs(strings.Split(tt.args, " ")), " ")
+		if result != tt.expected {
+			t.Errorf("expected %q to eq %q", result, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+TOOL = tool
+PARTS = include/sub/*.mk
+
+common:
+	@echo common
@@ -0,0 +1 @@
+include ../test017.mk
@@ -0,0 +1,2 @@
+searched:
+	@echo searched
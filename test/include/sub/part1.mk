@@ -0,0 +1,4 @@
+include searched.mk
+
+parts:
+	@echo parts
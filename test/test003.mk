@@ -3,10 +3,10 @@
 loop: rule1
 
 rule1: rule2
-	@echo "rule1"
+	@echo rule1
 
 rule2: rule3
-	@echo "rule2"
+	@echo rule2
 
 rule3: rule1
-	@echo "rule3"
+	@echo rule3
@@ -11,6 +11,6 @@ file2.tmp: file3.tmp
 	@echo "" > file2.tmp
 
 clean:
-	@del /q file1.tmp
-	@del /q file2.tmp
-	@del /q file3.tmp
+	@rm -f file1.tmp
+	@rm -f file2.tmp
+	@rm -f file3.tmp
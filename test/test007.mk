@@ -0,0 +1,20 @@
+# shell settings
+
+SHELL = /bin/sh
+.SHELLFLAGS = -ec
+
+all: strict lenient
+
+strict:
+	@echo strict
+
+lenient: .SHELLFLAGS = -c
+lenient:
+	@false; echo lenient
+
+errexit:
+	@false; echo errexit
+
+bash: SHELL = /bin/bash
+bash:
+	@[[ 1 == 1 ]] && echo bash
@@ -0,0 +1,11 @@
+target.tmp: dep1.tmp dep2.tmp
+	@echo target: run
+	@echo "" > target.tmp
+
+dep1.tmp:
+	@echo dep1: run
+	@echo "" > dep1.tmp
+
+dep2.tmp:
+	@echo dep2: run
+	@echo "" > dep2.tmp
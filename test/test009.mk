@@ -0,0 +1,9 @@
+# automatic variables
+
+all: echo3 echo4
+
+echo3 echo4: dir/echo1 echo2
+	@echo $@ from $< and $^
+
+dir/echo1 echo2:
+	@echo $(@D) $(@F)
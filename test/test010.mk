@@ -0,0 +1,12 @@
+# pattern rules
+
+all: test/test010.out
+
+%.out: %.mid
+	@echo generic $@ from $<
+
+test/test%.out: test/test%.mid
+	@echo specific $@ from $< stem $*
+
+%.mid: %.src
+	@echo $@ from $< stem $*
@@ -0,0 +1,14 @@
+# keep going
+
+all: broken1 good broken2
+
+broken1: missing
+	@echo broken1
+
+good:
+	@echo good
+
+broken2:
+	@echo broken2
+	@exit 3
+	@echo not reached
@@ -0,0 +1,7 @@
+# command prefixes
+
+all:
+	-@exit 2
+	@- echo after ignored
+	+@echo forced
+	echo normal
@@ -0,0 +1,13 @@
+# phony targets
+
+.PHONY: clean
+.PHONY: build
+
+build: test/test013.mk
+	@echo build
+
+clean:
+	@echo clean
+
+output.tmp: build
+	@echo output
@@ -0,0 +1,9 @@
+# default goal
+
+.PHONY: echo1 echo2
+
+echo1 echo2:
+	@echo $@
+
+echo3:
+	@echo echo3
@@ -0,0 +1,11 @@
+# declared default goal
+
+GOAL = echo3
+
+echo1:
+	@echo echo1
+
+echo3:
+	@echo echo3
+
+.DEFAULT_GOAL = $(GOAL)
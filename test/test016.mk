@@ -0,0 +1,9 @@
+# include directives
+
+include include/common.mk
+-include include/missing.mk
+sinclude include/missing.mk
+include $(PARTS)
+
+all: common parts searched
+	@echo $(TOOL)
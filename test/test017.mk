@@ -0,0 +1,3 @@
+# include cycle
+
+include include/cycle.mk
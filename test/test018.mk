@@ -0,0 +1,9 @@
+# command line variables
+
+TOOL = gcc
+override FLAGS = -O2
+
+all:
+	@echo $(TOOL) $(FLAGS)
+	@echo $$TOOL
+	@echo $$MAKEFLAGS
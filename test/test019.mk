@@ -0,0 +1,9 @@
+# environment variables
+
+GOMK_ENV = makefile
+export GOMK_EXPORTED = exported
+GOMK_LOCAL = local
+
+all:
+	@echo $(GOMK_ENV)
+	@echo $$GOMK_ENV $$GOMK_EXPORTED $$GOMK_LOCAL
@@ -0,0 +1,10 @@
+# canned recipes
+
+define greet
+echo hello $@
+-exit 1
+echo bye $@
+endef
+
+all:
+	@$(greet)
@@ -0,0 +1,15 @@
+# multiple rule entries
+
+all: main.o
+all: util.o
+
+main.o: main.h
+%.o:
+	@echo build $@ from $^
+
+util.o: util.h
+	@echo compile $@ from $^
+util.o:
+	@echo recompile $@ from $^
+
+main.h util.h:
@@ -0,0 +1,13 @@
+# recipes are expanded when they run
+
+all:
+	@echo all
+
+clean:
+	@echo $(shell touch shell.tmp)
+
+objs: gen
+	@echo objs=$(wildcard *.gen.tmp)
+
+gen:
+	@touch a.gen.tmp
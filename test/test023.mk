@@ -0,0 +1,16 @@
+# rules with substitution references
+
+SRCS = main.c util.c
+
+all: $(SRCS:.c=.o)
+	@echo all from $^
+
+$(SRCS:.c=.o): common.h
+	@echo $@ from $^
+
+${SRCS:.c=.h}:
+	@echo $@
+
+common.h: ${SRCS:.c=.h}
+
+.PHONY: all common.h $(SRCS:.c=.o) ${SRCS:.c=.h}
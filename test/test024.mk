@@ -0,0 +1,12 @@
+# goals sharing a dependency
+
+.PHONY: a b c
+
+a: c
+	@echo a
+
+b: c
+	@echo b
+
+c:
+	@echo c
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"io"
 	"os"
+	"strings"
+	"sync"
 )
 
 func inArray(array []string, target string) bool {
@@ -13,14 +16,16 @@ func inArray(array []string, target string) bool {
 	return false
 }
 
-func searchMapKeys(m map[string]int, value int) []string {
-	keys := []string{}
-	for k, v := range m {
-		if v == value {
-			keys = append(keys, k)
-		}
-	}
-	return keys
+// stringList is a flag value which may be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
 func modTime(path string) (int64, error) {
@@ -31,3 +36,26 @@ func modTime(path string) (int64, error) {
 
 	return fs.ModTime().UnixNano(), nil
 }
+
+func fileExists(path string) bool {
+	_, err := modTime(path)
+	return err == nil
+}
+
+type syncWriter struct {
+	mutex  *sync.Mutex
+	writer io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writer.Write(p)
+}
+
+// newSyncWriters returns writers which are safe for concurrent use.
+// They share one lock since both may write to the same stream.
+func newSyncWriters(out, err io.Writer) (io.Writer, io.Writer) {
+	mutex := &sync.Mutex{}
+	return &syncWriter{mutex, out}, &syncWriter{mutex, err}
+}
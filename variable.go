@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var assign_class = regexp.MustCompile(`^[^\s:=+]+:?=`)
+
+// isAssignArg reports whether arg is a variable assignment like "NAME=value".
+func isAssignArg(arg string) bool {
+	return assign_class.MatchString(arg)
+}
+
+// splitAssignArgs separates the variable assignments from the targets.
+func splitAssignArgs(args []string) (assigns, targets []string) {
+	assigns, targets = []string{}, []string{}
+	for _, arg := range args {
+		if isAssignArg(arg) {
+			assigns = append(assigns, arg)
+		} else {
+			targets = append(targets, arg)
+		}
+	}
+	return
+}
+
+// encodeMakeflags returns the MAKEFLAGS value which passes assigns
+// to recursive invocations. Whitespaces in values are escaped.
+func encodeMakeflags(assigns []string) string {
+	words := []string{"--"}
+	for _, assign := range assigns {
+		assign = strings.Replace(assign, `\`, `\\`, -1)
+		assign = strings.Replace(assign, " ", `\ `, -1)
+		assign = strings.Replace(assign, "\t", "\\\t", -1)
+		words = append(words, assign)
+	}
+	return strings.Join(words, " ")
+}
+
+// decodeMakeflags returns the variable assignments in MAKEFLAGS value.
+// When the value has the "--" separator, only the words after it are
+// assignments. Otherwise options starting with '-' are skipped.
+func decodeMakeflags(flags string) []string {
+	words := []string{}
+
+	word := []byte{}
+	for i := 0; i < len(flags); i++ {
+		switch c := flags[i]; {
+		case c == '\\' && i+1 < len(flags):
+			i++
+			word = append(word, flags[i])
+		case c == ' ' || c == '\t':
+			if len(word) > 0 {
+				words = append(words, string(word))
+			}
+			word = []byte{}
+		default:
+			word = append(word, c)
+		}
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+
+	for i, w := range words {
+		if w == "--" {
+			words = words[i+1:]
+			break
+		}
+	}
+
+	assigns := []string{}
+	for _, w := range words {
+		if !strings.HasPrefix(w, "-") && isAssignArg(w) {
+			assigns = append(assigns, w)
+		}
+	}
+	return assigns
+}